@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/middleware"
+)
+
+const usage = `usage: client [flags]
+
+Sends the Steam games and reviews CSVs of a client, the games first, and
+the end of stream of each once it is sent. Bad rows are skipped and counted
+by reason.
+
+Every batch the broker took is checkpointed, with the byte offset reached
+in each file. After a crash, -resume goes on from the checkpoint with the
+same client id. The messages are numbered as before only if PRODUCER_ID is
+the same, so the ones sent twice are deduplicated.
+
+flags:
+`
+
+// Columns a row needs to be parsed at all.
+const (
+	gameColumns   = 37
+	reviewColumns = 4
+)
+
+// Reasons a row is skipped.
+const (
+	reasonMalformed     = "malformed csv"
+	reasonColumns       = "too few columns"
+	reasonInvalidGame   = "invalid game"
+	reasonInvalidReview = "invalid review"
+)
+
+type options struct {
+	games      string
+	reviews    string
+	clientId   string
+	batch      int
+	checkpoint string
+	resume     bool
+	progress   time.Duration
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.games, "games", "./data/games.csv", "path of the games CSV")
+	flag.StringVar(&opts.reviews, "reviews", "./data/reviews.csv", "path of the reviews CSV")
+	flag.StringVar(&opts.clientId, "client", "", "client id, a new one by default")
+	flag.IntVar(&opts.batch, "batch", 500, "reviews per batch, and messages between checkpoints")
+	flag.StringVar(&opts.checkpoint, "checkpoint", "./client-checkpoint.json", "path of the checkpoint")
+	flag.BoolVar(&opts.resume, "resume", false, "resume from the checkpoint")
+	flag.DurationVar(&opts.progress, "progress", 5*time.Second, "how often the progress is logged")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if opts.batch < 1 {
+		log.Fatalf("invalid batch %d", opts.batch)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	state, err := loadCheckpoint(opts)
+	if err != nil {
+		log.Fatalf("failed to load the checkpoint: %v", err)
+	}
+
+	m, err := middleware.NewMiddleware()
+	if err != nil {
+		panic(err)
+	}
+	defer m.Close()
+	m.SetSequences(state.Sequences)
+
+	c := &client{middleware: m, opts: opts, state: state, files: durability.NewFiles(durability.Commit)}
+
+	log.Printf("Sending the dataset of client %s", state.ClientId)
+
+	err = c.send(ctx, c.games())
+	if err == nil {
+		err = c.send(ctx, c.reviews())
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Interrupted, resume with -resume")
+		return
+	}
+	if err != nil {
+		log.Fatalf("failed to send: %v", err)
+	}
+
+	for _, name := range []string{"games", "reviews"} {
+		p := state.progress(name)
+		log.Printf("Sent %d %s, skipped %d", p.Sent, name, total(p.Skipped))
+		for reason, count := range p.Skipped {
+			log.Printf("  %s: %d", reason, count)
+		}
+	}
+}
+
+// checkpoint is how far the client got, saved after every batch the broker
+// took.
+type checkpoint struct {
+	ClientId  string
+	Games     progress
+	Reviews   progress
+	Sequences map[string]int64
+}
+
+// progress is how far the client got in a file.
+type progress struct {
+	// Offset is where the first row not sent yet starts.
+	Offset  int64
+	Sent    int
+	Skipped map[string]int
+	// Done is set once the end of stream of the file was sent.
+	Done bool
+}
+
+func (c *checkpoint) progress(name string) *progress {
+	if name == "games" {
+		return &c.Games
+	}
+	return &c.Reviews
+}
+
+// loadCheckpoint returns the checkpoint to resume from, or a new one.
+func loadCheckpoint(opts options) (*checkpoint, error) {
+	if !opts.resume {
+		clientId := opts.clientId
+		if clientId == "" {
+			clientId = fmt.Sprintf("client-%d", time.Now().UnixNano())
+		}
+		return &checkpoint{ClientId: clientId}, nil
+	}
+
+	data, err := os.ReadFile(opts.checkpoint)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no checkpoint in %s to resume from", opts.checkpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state checkpoint
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	if opts.clientId != "" && opts.clientId != state.ClientId {
+		return nil, fmt.Errorf("checkpoint is of client %s, not %s", state.ClientId, opts.clientId)
+	}
+
+	log.Printf("Resuming games at byte %d and reviews at byte %d", state.Games.Offset, state.Reviews.Offset)
+	return &state, nil
+}
+
+type client struct {
+	middleware *middleware.Middleware
+	opts       options
+	state      *checkpoint
+	files      *durability.Files
+}
+
+// source is a CSV file and how its rows are sent.
+type source struct {
+	name    string
+	path    string
+	columns int
+	// add parses a row and holds it to be sent, or returns why it is skipped.
+	add func(record []string) string
+	// flush sends the rows held, waiting for the broker to take them.
+	flush func() error
+	// finish sends the end of stream of the file.
+	finish func() error
+}
+
+func (c *client) games() *source {
+	var pending []*middleware.GameMsg
+
+	return &source{
+		name:    "games",
+		path:    c.opts.games,
+		columns: gameColumns,
+		add: func(record []string) string {
+			game := middleware.NewGame(record)
+			if game == nil {
+				return reasonInvalidGame
+			}
+			pending = append(pending, &middleware.GameMsg{ClientId: c.state.ClientId, Game: game})
+			return ""
+		},
+		// a game the broker did not take fails the batch before it is
+		// checkpointed, the resume sends it again
+		flush: func() error {
+			if len(pending) == 0 {
+				return nil
+			}
+			err := c.middleware.SendGameMsgsAndWait(pending)
+			if err != nil {
+				return err
+			}
+			pending = nil
+			return nil
+		},
+		finish: func() error {
+			return c.middleware.SendGameFinished(c.state.ClientId)
+		},
+	}
+}
+
+func (c *client) reviews() *source {
+	batch := &middleware.ReviewsBatch{ClientId: c.state.ClientId}
+
+	return &source{
+		name:    "reviews",
+		path:    c.opts.reviews,
+		columns: reviewColumns,
+		add: func(record []string) string {
+			review := middleware.NewReview(record)
+			if review == nil {
+				return reasonInvalidReview
+			}
+			batch.Reviews = append(batch.Reviews, *review)
+			return ""
+		},
+		flush: func() error {
+			if len(batch.Reviews) == 0 {
+				return nil
+			}
+			err := c.middleware.SendReviewBatchAndWait(batch)
+			if err != nil {
+				return err
+			}
+			batch = &middleware.ReviewsBatch{ClientId: c.state.ClientId}
+			return nil
+		},
+		finish: func() error {
+			return c.middleware.SendReviewsFinished(c.state.ClientId)
+		},
+	}
+}
+
+// send sends the rows of s from the offset of the checkpoint on,
+// checkpointing every batch rows sent. When ctx is done it checkpoints the
+// rows read so far and returns its error.
+func (c *client) send(ctx context.Context, s *source) error {
+	p := c.state.progress(s.name)
+	if p.Done {
+		log.Printf("The %s were already sent", s.name)
+		return nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(p.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	// the header
+	if p.Offset == 0 {
+		_, err := reader.Read()
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	start := p.Offset
+	offset := start + reader.InputOffset()
+	pending := 0
+	skipped := make(map[string]int)
+
+	commit := func() error {
+		err := s.flush()
+		if err != nil {
+			return err
+		}
+
+		p.Offset = offset
+		p.Sent += pending
+		if p.Skipped == nil {
+			p.Skipped = make(map[string]int)
+		}
+		for reason, count := range skipped {
+			p.Skipped[reason] += count
+		}
+		pending = 0
+		clear(skipped)
+
+		return c.save()
+	}
+
+	lastLog := time.Now()
+	for {
+		if ctx.Err() != nil {
+			err := commit()
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var parseErr *csv.ParseError
+		switch {
+		case errors.As(err, &parseErr):
+			skipped[reasonMalformed]++
+		case err != nil:
+			return err
+		case len(record) < s.columns:
+			skipped[reasonColumns]++
+		default:
+			if reason := s.add(record); reason != "" {
+				skipped[reason]++
+			} else {
+				pending++
+			}
+		}
+		offset = start + reader.InputOffset()
+
+		if pending == c.opts.batch {
+			err := commit()
+			if err != nil {
+				return err
+			}
+		}
+
+		if time.Since(lastLog) >= c.opts.progress {
+			lastLog = time.Now()
+			log.Printf("%s: %.1f%%, %d sent, %d skipped", s.name, percent(offset, info.Size()), p.Sent+pending, total(p.Skipped)+total(skipped))
+		}
+	}
+
+	err = commit()
+	if err != nil {
+		return err
+	}
+
+	err = s.finish()
+	if err != nil {
+		return err
+	}
+
+	p.Done = true
+	log.Printf("Sent the %s and their end of stream", s.name)
+	return c.save()
+}
+
+// save writes the checkpoint with the sequence numbers reached, which match
+// the offsets since every row before them was sent.
+func (c *client) save() error {
+	c.state.Sequences = c.middleware.Sequences()
+
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+
+	err = c.files.WriteAtomic(c.opts.checkpoint, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.files.Sync()
+}
+
+func percent(offset int64, size int64) float64 {
+	if size == 0 {
+		return 100
+	}
+	return 100 * float64(offset) / float64(size)
+}
+
+func total(counts map[string]int) int {
+	n := 0
+	for _, count := range counts {
+		n += count
+	}
+	return n
+}
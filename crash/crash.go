@@ -0,0 +1,80 @@
+package crash
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Point names, in the order a stats message goes through them.
+const (
+	// CommitWrite is right after the transaction is appended to the WAL.
+	CommitWrite = "commit-write"
+	// StoreAppend is right after a row is appended to a store file.
+	StoreAppend = "store-append"
+	// TempWrite is after a temp file is written, before it is renamed.
+	TempWrite = "temp-write"
+	// Rename is right after a temp file is renamed in place.
+	Rename = "rename"
+	// ProcessedAppend is right after a processed id is appended to its log.
+	ProcessedAppend = "processed-append"
+	// CommitEnd is after the transaction is applied and marked as such.
+	CommitEnd = "commit-end"
+	// Ack is right before a message is acked.
+	Ack = "ack"
+)
+
+var Points = []string{CommitWrite, StoreAppend, TempWrite, Rename, ProcessedAppend, CommitEnd, Ack}
+
+// The crash point is set through the environment, so a harness can arm it in
+// a child process: CRASH_POINT names the point and CRASH_AFTER how many times
+// it is reached before crashing, 1 by default.
+const (
+	EnvPoint = "CRASH_POINT"
+	EnvAfter = "CRASH_AFTER"
+)
+
+// ExitCode is the status of a process killed at a crash point, the one of a
+// SIGKILL.
+const ExitCode = 137
+
+var (
+	mutex   sync.Mutex
+	armed   = os.Getenv(EnvPoint)
+	after   = 1
+	reached = 0
+)
+
+func init() {
+	if value, err := strconv.Atoi(os.Getenv(EnvAfter)); err == nil && value > 0 {
+		after = value
+	}
+}
+
+// Point exits the process right away if it is the armed point and was
+// reached CRASH_AFTER times. Deferred calls and buffered writes are lost as
+// in a kill; what was written to files survives, as the OS still has it.
+func Point(name string) {
+	if armed != name {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	reached++
+	if reached == after {
+		log.Printf("Crashing at %s after reaching it %d times", name, reached)
+		os.Exit(ExitCode)
+	}
+}
+
+// Reached returns how many times the armed point was reached, for a harness
+// to learn how often a run reaches it.
+func Reached() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return reached
+}
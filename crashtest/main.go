@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/crash"
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/statsdb"
+	"github.com/LucasAlda/demo-falopa/store"
+)
+
+// crashtest checks that the stats worker counts every message exactly once
+// across crashes. For every crash point it runs a worker in a child process
+// with the point armed, plays the broker for it, and restarts it once it
+// dies, redelivering every message it did not ack, until all of them are.
+// The totals in the database are then compared with the ones expected. The
+// hashmap store gets a single bucket by default, so the runs compact it.
+//
+// The child reads messages from stdin, one `id` per line, and writes `ack id`
+// to stdout for every message it acks, and `reached n` once it stops cleanly,
+// n being how many times it reached the armed point. The content of a message
+// is derived from its id, so parent and child agree on it.
+
+const childEnv = "CRASHTEST_CHILD"
+
+const apps = 7
+
+func message(id int64) *middleware.StatsMsg {
+	stats := &middleware.Stats{AppId: int(id % apps), Name: "game " + strconv.Itoa(int(id%apps))}
+	if id%3 == 0 {
+		stats.Negatives = 1
+	} else {
+		stats.Positives = 1
+	}
+
+	return &middleware.StatsMsg{Id: id, Stats: stats}
+}
+
+type config struct {
+	messages   int
+	batch      int
+	store      string
+	buckets    int
+	durability string
+	verbose    bool
+}
+
+func main() {
+	var cfg config
+	flag.IntVar(&cfg.messages, "messages", 100, "messages sent to the worker")
+	flag.IntVar(&cfg.batch, "batch", 1, "messages per transaction")
+	flag.StringVar(&cfg.store, "store", "", "store backend of the stats")
+	flag.IntVar(&cfg.buckets, "buckets", 1, "buckets of the hashmap store, few enough for it to compact")
+	flag.StringVar(&cfg.durability, "durability", "commit", "durability level: none, commit or full")
+	flag.BoolVar(&cfg.verbose, "v", false, "show the worker logs")
+	points := flag.String("points", "", "crash points to test, comma separated, all the store reaches by default")
+	flag.Parse()
+
+	level, err := durability.ParseLevel(cfg.durability)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if os.Getenv(childEnv) != "" {
+		err := child(flag.Arg(0), cfg, level)
+		if err != nil {
+			log.Fatalf("worker: %v", err)
+		}
+		return
+	}
+
+	if cfg.store == store.BackendMemory {
+		log.Fatalf("the %s store does not survive a crash", store.BackendMemory)
+	}
+
+	selected := storePoints(cfg.store)
+	if *points != "" {
+		selected = strings.Split(*points, ",")
+	}
+
+	if !runPoints(cfg, level, selected, os.Stdout) {
+		os.Exit(1)
+	}
+}
+
+// storePoints returns the crash points a run over backend reaches. The files
+// store never appends, and the file store only writes a temp file to compact,
+// after 1000 dead rows: test it with -messages 1100 -points temp-write,rename.
+func storePoints(backend string) []string {
+	switch backend {
+	case store.BackendFiles:
+		return slices.DeleteFunc(slices.Clone(crash.Points), func(point string) bool {
+			return point == crash.StoreAppend
+		})
+	case store.BackendFile:
+		return slices.DeleteFunc(slices.Clone(crash.Points), func(point string) bool {
+			return point == crash.TempWrite || point == crash.Rename
+		})
+	}
+	return crash.Points
+}
+
+// runPoints crashes a worker at every point and reports each run to out. It
+// fails if a run loses or counts twice a message, or never crashes, and if a
+// point is never reached, since a point never crashed at tests nothing.
+func runPoints(cfg config, level durability.Level, points []string, out io.Writer) bool {
+	failed := 0
+	for _, point := range points {
+		reached, err := count(cfg, point)
+		if err == nil && reached == 0 {
+			err = errors.New("never reached")
+		}
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", point, err)
+			failed++
+			continue
+		}
+
+		// crash on the first time the point is reached, and again halfway
+		// through the times a run without crashes reaches it
+		afters := []int{1}
+		if middle := reached/2 + 1; middle > 1 {
+			afters = append(afters, middle)
+		}
+
+		for _, after := range afters {
+			result, err := run(cfg, level, point, after)
+			if err != nil {
+				fmt.Fprintf(out, "FAIL %s after %d of %d: %v\n", point, after, reached, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(out, "ok   %s after %d of %d: %s\n", point, after, reached, result)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(out, "%d failed\n", failed)
+	}
+	return failed == 0
+}
+
+// count processes every message in a single start with point armed too far
+// to crash, and returns how many times it was reached.
+func count(cfg config, point string) (int, error) {
+	dir, err := os.MkdirTemp("", "crashtest-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	unacked := make(map[int64]bool)
+	for id := int64(1); id <= int64(cfg.messages); id++ {
+		unacked[id] = true
+	}
+
+	env := []string{childEnv + "=1", crash.EnvPoint + "=" + point, crash.EnvAfter + "=" + strconv.Itoa(math.MaxInt32)}
+	code, reached, err := start(cfg, dir, env, unacked)
+	if err != nil {
+		return 0, err
+	}
+	if code != 0 {
+		return 0, fmt.Errorf("worker exited with status %d", code)
+	}
+
+	return reached, nil
+}
+
+// run processes every message with point armed on the first start and
+// checks the totals.
+func run(cfg config, level durability.Level, point string, after int) (string, error) {
+	dir, err := os.MkdirTemp("", "crashtest-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	unacked := make(map[int64]bool)
+	for id := int64(1); id <= int64(cfg.messages); id++ {
+		unacked[id] = true
+	}
+
+	starts, crashed, redelivered := 0, false, 0
+	for len(unacked) > 0 {
+		if starts == 10 {
+			return "", fmt.Errorf("%d messages still unacked after %d starts", len(unacked), starts)
+		}
+
+		env := []string{childEnv + "=1"}
+		if starts == 0 {
+			env = append(env, crash.EnvPoint+"="+point, crash.EnvAfter+"="+strconv.Itoa(after))
+		} else {
+			redelivered += len(unacked)
+		}
+		starts++
+
+		code, _, err := start(cfg, dir, env, unacked)
+		if err != nil {
+			return "", err
+		}
+
+		switch code {
+		case 0:
+		case crash.ExitCode:
+			crashed = true
+		default:
+			return "", fmt.Errorf("worker exited with status %d", code)
+		}
+	}
+
+	err = check(cfg, dir, level)
+	if err != nil {
+		return "", err
+	}
+
+	if !crashed {
+		return "", fmt.Errorf("point not reached in %d starts", starts)
+	}
+
+	return fmt.Sprintf("%d starts, %d redelivered", starts, redelivered), nil
+}
+
+// start runs a worker over the unacked messages, in id order, and removes
+// the ones it acks. It returns the exit status of the worker and, if it
+// stopped cleanly, how many times it reached the armed point.
+func start(cfg config, dir string, env []string, unacked map[int64]bool) (int, int, error) {
+	args := []string{
+		"-batch", strconv.Itoa(cfg.batch),
+		"-store", cfg.store,
+		"-buckets", strconv.Itoa(cfg.buckets),
+		"-durability", cfg.durability,
+		dir,
+	}
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), env...)
+	if cfg.verbose {
+		cmd.Stderr = os.Stderr
+	}
+
+	var input strings.Builder
+	for id := int64(1); id <= int64(cfg.messages); id++ {
+		if unacked[id] {
+			fmt.Fprintln(&input, id)
+		}
+	}
+	cmd.Stdin = strings.NewReader(input.String())
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	reached := 0
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var id int64
+		if _, err := fmt.Sscanf(scanner.Text(), "ack %d", &id); err == nil {
+			delete(unacked, id)
+			continue
+		}
+		if _, err := fmt.Sscanf(scanner.Text(), "reached %d", &reached); err != nil {
+			return 0, 0, fmt.Errorf("unexpected worker output %q", scanner.Text())
+		}
+	}
+
+	err = cmd.Wait()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode(), 0, nil
+	}
+
+	return 0, reached, err
+}
+
+// check compares the stats in dir with the totals of every message.
+func check(cfg config, dir string, level durability.Level) error {
+	expected := make(map[string]middleware.Stats)
+	for id := int64(1); id <= int64(cfg.messages); id++ {
+		stats := message(id).Stats
+		key := strconv.Itoa(stats.AppId)
+		total := expected[key]
+		total.Name = stats.Name
+		total.Positives += stats.Positives
+		total.Negatives += stats.Negatives
+		expected[key] = total
+	}
+
+	db, err := statsdb.Open(dir, statsdb.Options{Backend: cfg.store, Buckets: cfg.buckets, Durability: level})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if pending := db.Commits.Pending(); pending > 0 {
+		return fmt.Errorf("%d transactions left in the WAL after a clean stop", pending)
+	}
+
+	found := 0
+	err = db.Stats.Iterate(func(key string, value middleware.Stats) error {
+		found++
+		want, ok := expected[key]
+		if !ok {
+			return fmt.Errorf("unexpected stats for %s", key)
+		}
+		if value.Positives != want.Positives || value.Negatives != want.Negatives {
+			return fmt.Errorf("stats for %s are %d positives, %d negatives, expected %d, %d", key, value.Positives, value.Negatives, want.Positives, want.Negatives)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if found != len(expected) {
+		return fmt.Errorf("found stats for %d apps, expected %d", found, len(expected))
+	}
+
+	return nil
+}
+
+// child is the worker: it recovers the database, processes the messages in
+// stdin and stops cleanly at its end.
+func child(dir string, cfg config, level durability.Level) error {
+	db, err := statsdb.Open(dir, statsdb.Options{Backend: cfg.store, Buckets: cfg.buckets, Durability: level})
+	if err != nil {
+		return err
+	}
+
+	err = db.Recover()
+	if err != nil {
+		return err
+	}
+
+	batch := statsdb.NewBatch(db, cfg.batch, time.Hour)
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		id, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		err = batch.Process(message(id), func() {
+			fmt.Printf("ack %d\n", id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = batch.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("reached %d\n", crash.Reached())
+	return nil
+}
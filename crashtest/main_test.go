@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/store"
+)
+
+// TestMain runs the worker when the test binary is started as the child of
+// the harness.
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Every point the hashmap and files stores reach is crashed at, with the
+// hashmap compacting along the way.
+func TestCrashPoints(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a worker per crash")
+	}
+
+	for _, backend := range []string{store.BackendHashMap, store.BackendFiles} {
+		t.Run(backend, func(t *testing.T) {
+			cfg := config{messages: 100, batch: 1, store: backend, buckets: 1, durability: "commit"}
+
+			var out strings.Builder
+			if !runPoints(cfg, durability.Commit, storePoints(backend), &out) {
+				t.Fatal(out.String())
+			}
+			t.Log(out.String())
+		})
+	}
+}
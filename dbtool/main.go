@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/statsdb"
+	"github.com/LucasAlda/demo-falopa/store"
+	"github.com/LucasAlda/demo-falopa/txn"
+)
+
+// Files left in a database root by the workers that predate statsdb. The
+// worker replays the last complete block of the commit and migrates the ids
+// when it opens the database.
+const (
+	legacyProcessed = "processed.bin"
+	legacyCommit    = "commit.csv"
+)
+
+const usage = `usage: dbtool <command> [flags] <database path>
+
+commands:
+  verify   check the WAL, the processed ids and the stats of a database
+  dump     print every stats record as CSV or JSON
+  dups     report duplicate processed ids
+  repair   replay (-action replay) or discard (-action discard) the
+           transactions left in the WAL
+
+A worker keeps a database per client, in database/clients/client-<id>. The
+database of an older worker is moved to database/clients/client- on startup.
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands := map[string]func(args []string) error{
+		"verify": verify,
+		"dump":   dump,
+		"dups":   dups,
+		"repair": repair,
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	err := command(os.Args[2:])
+	if err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+// flags returns the flag set of a command, with the flags every command
+// shares.
+func flags(name string, backend *string) *flag.FlagSet {
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(backend, "store", store.BackendHashMap, "store backend of the stats: hashmap, files or file")
+	return set
+}
+
+// parse parses args and returns the database path, the only positional
+// argument.
+func parse(set *flag.FlagSet, args []string) (string, error) {
+	set.Parse(args)
+	if set.NArg() != 1 {
+		return "", fmt.Errorf("expected the database path, got %d arguments", set.NArg())
+	}
+
+	path := set.Arg(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+
+	return path, nil
+}
+
+func open(path string, backend string, readOnly bool) (*statsdb.DB, error) {
+	if backend == store.BackendMemory {
+		return nil, fmt.Errorf("the memory backend keeps nothing on disk")
+	}
+
+	return statsdb.Open(path, statsdb.Options{Backend: backend, ReadOnly: readOnly})
+}
+
+// pendingIDs returns the processed id of every transaction left in the WAL,
+// by sequence number.
+func pendingIDs(db *statsdb.DB) (map[uint64]statsdb.ProcessedID, error) {
+	ids := make(map[uint64]statsdb.ProcessedID)
+
+	err := db.Transactions.Inspect(func(seq uint64, ops [][]string) error {
+		value, ok := txn.MetaValue(ops, statsdb.ProcessedMeta)
+		if !ok {
+			return nil
+		}
+
+		id, err := statsdb.ParseProcessedID(value)
+		if err != nil {
+			return fmt.Errorf("transaction %d: invalid processed id %q", seq, value)
+		}
+
+		ids[seq] = id
+		return nil
+	})
+
+	return ids, err
+}
+
+func sortedSeqs(ids map[uint64]statsdb.ProcessedID) []uint64 {
+	seqs := make([]uint64, 0, len(ids))
+	for seq := range ids {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// verify reports what the worker would find on startup. Warnings are fixed by
+// the next startup or a repair, errors need a look by hand and make the
+// command fail.
+func verify(args []string) error {
+	var backend string
+	set := flags("verify", &backend)
+	path, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := open(path, backend, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	errs := 0
+	warn := func(format string, args ...any) {
+		fmt.Printf("warning: "+format+"\n", args...)
+	}
+	fail := func(format string, args ...any) {
+		fmt.Printf("error: "+format+"\n", args...)
+		errs++
+	}
+
+	if torn := db.Commits.Torn(); torn != nil {
+		warn("WAL has a %v, it is truncated on startup", torn)
+	}
+
+	tracker := db.Processed.Tracker()
+	if torn := tracker.Torn(); torn != nil {
+		warn("processed ids have a %v, it is truncated on startup", torn)
+	}
+
+	producers, sparse := tracker.Len()
+	fmt.Printf("processed ids: %d producers, %d out of order ids\n", producers, sparse)
+	tracker.Each(func(producer string, watermark int64, ids []int64) {
+		fmt.Printf("  producer %q: watermark %d, %d out of order\n", producer, watermark, len(ids))
+	})
+
+	pending, err := pendingIDs(db)
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Printf("pending transactions: %d\n", db.Commits.Pending())
+	for _, seq := range sortedSeqs(pending) {
+		id := pending[seq]
+		if db.Processed.Contains(id) {
+			// the crash hit between applying it and marking it applied,
+			// the replay rewrites the same values
+			warn("transaction %d for id %s is pending but the id is already processed", seq, id)
+		} else {
+			warn("transaction %d for id %s is pending, it is rolled forward on startup", seq, id)
+		}
+	}
+
+	records := 0
+	err = db.Stats.Iterate(func(key string, value middleware.Stats) error {
+		if _, err := strconv.Atoi(key); err != nil {
+			fail("stats key %q is not an AppId", key)
+		}
+		if value.Positives < 0 || value.Negatives < 0 {
+			fail("stats of %s have negative counts: %d positives, %d negatives", key, value.Positives, value.Negatives)
+		}
+		records++
+		return nil
+	})
+	if err != nil {
+		fail("failed to read the stats: %v", err)
+	}
+	fmt.Printf("stats records: %d\n", records)
+
+	temps, err := db.TempFiles()
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		warn("temp file %s (%d bytes) is removed on startup", temp.Path, temp.Size)
+	}
+
+	for _, name := range []string{legacyProcessed, legacyCommit} {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			warn("legacy %s found, migrated when the worker opens the database, see dups", name)
+		}
+	}
+
+	if errs > 0 {
+		return fmt.Errorf("%d errors found", errs)
+	}
+
+	fmt.Println("ok")
+	return nil
+}
+
+type record struct {
+	AppId     int    `json:"app_id"`
+	Name      string `json:"name"`
+	Positives int    `json:"positives"`
+	Negatives int    `json:"negatives"`
+}
+
+// dump prints the stats as stored, transactions left in the WAL are not
+// applied.
+func dump(args []string) error {
+	var backend string
+	set := flags("dump", &backend)
+	format := set.String("format", "csv", "output format: csv or json")
+	path, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+
+	db, err := open(path, backend, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	writer := csv.NewWriter(out)
+	encoder := json.NewEncoder(out)
+
+	if *format == "csv" {
+		writer.Write([]string{"app_id", "name", "positives", "negatives"})
+	}
+
+	err = db.Stats.Iterate(func(key string, value middleware.Stats) error {
+		if *format == "csv" {
+			return writer.Write([]string{key, value.Name, strconv.Itoa(value.Positives), strconv.Itoa(value.Negatives)})
+		}
+
+		appId, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("stats key %q is not an AppId", key)
+		}
+		return encoder.Encode(record{AppId: appId, Name: value.Name, Positives: value.Positives, Negatives: value.Negatives})
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// dups reports the ids written more than once to a legacy processed.bin, and
+// the ids of more than one pending transaction. A pending transaction whose id
+// is already processed is not a duplicate: replaying it writes the same
+// values again.
+func dups(args []string) error {
+	var backend string
+	set := flags("dups", &backend)
+	path, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+
+	found, err := legacyDups(filepath.Join(path, legacyProcessed))
+	if err != nil {
+		return err
+	}
+
+	db, err := open(path, backend, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	pending, err := pendingIDs(db)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[statsdb.ProcessedID]uint64)
+	for _, seq := range sortedSeqs(pending) {
+		id := pending[seq]
+		if first, ok := seen[id]; ok {
+			fmt.Printf("id %s: pending in transactions %d and %d\n", id, first, seq)
+			found++
+			continue
+		}
+		seen[id] = seq
+	}
+
+	fmt.Printf("%d duplicates\n", found)
+	return nil
+}
+
+func legacyDups(path string) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	counts := make(map[int32]int)
+	var order []int32
+
+	for {
+		var id int32
+		err := binary.Read(reader, binary.BigEndian, &id)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Printf("%s: torn last id\n", path)
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if counts[id] == 0 {
+			order = append(order, id)
+		}
+		counts[id]++
+	}
+
+	found := 0
+	for _, id := range order {
+		if counts[id] > 1 {
+			fmt.Printf("id %d: %d times in %s\n", id, counts[id], path)
+			found++
+		}
+	}
+
+	return found, nil
+}
+
+// repair settles the transactions left in the WAL, either rolling them
+// forward as the worker does on startup or dropping them. Discarded
+// transactions are lost: their messages were never acknowledged, so they
+// are only safe to drop if they will be delivered again.
+func repair(args []string) error {
+	var backend string
+	set := flags("repair", &backend)
+	action := set.String("action", "replay", "what to do with pending transactions: replay or discard")
+	path, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+
+	if *action != "replay" && *action != "discard" {
+		return fmt.Errorf("unknown action: %s", *action)
+	}
+
+	db, err := open(path, backend, false)
+	if err != nil {
+		return err
+	}
+
+	if *action == "replay" {
+		err = db.Recover()
+	} else {
+		var discarded int
+		discarded, err = db.Transactions.Discard()
+		fmt.Printf("discarded %d transactions\n", discarded)
+	}
+
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,502 @@
+package dedup
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/LucasAlda/demo-falopa/crash"
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+const (
+	snapshotFile = "snapshot.bin"
+	logFile      = "log.bin"
+)
+
+const (
+	DefaultMaxSparse    = 100_000
+	DefaultCompactEvery = 10_000
+)
+
+type Options struct {
+	// MaxSparse is how many out of order ids are kept per producer. Past it
+	// the watermark is moved up to the oldest of them, and any id below it
+	// that was never seen is from then on taken as processed.
+	MaxSparse int
+	// CompactEvery is how many ids are appended to the log between two
+	// snapshots.
+	CompactEvery int
+	Durability   durability.Level
+	// ReadOnly opens the tracker without changing it: a torn log tail is
+	// reported by Torn instead of truncated, and no id can be added.
+	ReadOnly bool
+}
+
+var ErrReadOnly = errors.New("processed ids opened read only")
+
+// window holds the ids seen from a producer: every id up to watermark, plus
+// the sparse ids above it that arrived out of order. order is a min-heap of
+// the sparse ids.
+type window struct {
+	watermark int64
+	sparse    map[int64]bool
+	order     ids
+	// forced counts the times MaxSparse moved the watermark since the window
+	// last had room, so it is logged once per overflow and not on every id.
+	forced int
+}
+
+// ids is a min-heap of ids.
+type ids []int64
+
+func (h ids) Len() int           { return len(h) }
+func (h ids) Less(i, j int) bool { return h[i] < h[j] }
+func (h ids) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *ids) Push(x any)        { *h = append(*h, x.(int64)) }
+
+func (h *ids) Pop() any {
+	old := *h
+	id := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return id
+}
+
+// Tracker remembers which message ids were already processed, per producer.
+// Producers are expected to number their messages from 1 up, so most ids
+// collapse into the watermark and memory stays bounded by the out of order
+// ones.
+//
+// On disk it is a snapshot of every window plus a log of the ids added
+// since. The log is folded into a new snapshot every CompactEvery ids, so
+// startup only reads a bounded amount of data.
+type Tracker struct {
+	mutex     sync.Mutex
+	path      string
+	options   Options
+	files     *durability.Files
+	producers map[string]*window
+	log       *os.File
+	logged    int
+	torn      error
+}
+
+func Open(path string, options Options) (*Tracker, error) {
+	if options.MaxSparse <= 0 {
+		options.MaxSparse = DefaultMaxSparse
+	}
+	if options.CompactEvery <= 0 {
+		options.CompactEvery = DefaultCompactEvery
+	}
+
+	if !options.ReadOnly {
+		err := os.MkdirAll(path, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t := &Tracker{
+		path:      path,
+		options:   options,
+		files:     durability.NewFiles(options.Durability),
+		producers: make(map[string]*window),
+	}
+
+	err := t.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.loadLog()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *Tracker) loadSnapshot() error {
+	file, err := os.Open(filepath.Join(t.path, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+
+	err = readHeader(reader, kindSnapshot)
+	if err != nil {
+		return err
+	}
+
+	offset := int64(fileHeaderSize)
+	for {
+		payload, err := readBlock(reader, info.Size()-offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// snapshots are written atomically, a bad block is corruption
+			return fmt.Errorf("%w: %s: %v", ErrFormat, snapshotFile, err)
+		}
+
+		offset += int64(blockHeaderSize + len(payload))
+
+		d := &decoder{payload: payload}
+		w := t.window(d.producer())
+		w.watermark = d.id()
+		for range d.count() {
+			w.insert(d.id())
+		}
+
+		if err := d.done(); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *Tracker) loadLog() error {
+	path := filepath.Join(t.path, logFile)
+
+	if t.options.ReadOnly {
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return t.replayLog(file, path)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if info.Size() < fileHeaderSize {
+		// new log, or a crash before its header was written
+		err = t.resetLog(file)
+	} else {
+		err = t.replayLog(file, path)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	t.log = file
+	return t.files.Created(path)
+}
+
+func (t *Tracker) resetLog(file *os.File) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	return writeHeader(file, kindLog)
+}
+
+func (t *Tracker) replayLog(file *os.File, path string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+
+	err = readHeader(reader, kindLog)
+	if err != nil {
+		return err
+	}
+
+	offset := int64(fileHeaderSize)
+	for {
+		payload, err := readBlock(reader, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err == errTorn {
+			// A crash in the middle of an append leaves a torn last block,
+			// that id was never acknowledged so it is dropped.
+			t.torn = fmt.Errorf("torn tail of %s at offset %d", path, offset)
+			if t.options.ReadOnly {
+				break
+			}
+
+			log.Printf("Discarding %v", t.torn)
+			err = file.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		d := &decoder{payload: payload}
+		producer := d.producer()
+		id := d.id()
+		if err := d.done(); err != nil {
+			return err
+		}
+
+		t.add(producer, id)
+		t.logged++
+		offset += int64(blockHeaderSize + len(payload))
+	}
+
+	return nil
+}
+
+func (t *Tracker) window(producer string) *window {
+	w, ok := t.producers[producer]
+	if !ok {
+		w = &window{sparse: make(map[int64]bool)}
+		t.producers[producer] = w
+	}
+	return w
+}
+
+// Contains reports whether id from producer was already added.
+func (t *Tracker) Contains(producer string, id int64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	w, ok := t.producers[producer]
+	if !ok {
+		return false
+	}
+
+	return id <= w.watermark || w.sparse[id]
+}
+
+// Add records id from producer as processed. Adding an id twice is a no-op.
+func (t *Tracker) Add(producer string, id int64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	w := t.window(producer)
+	if id <= w.watermark || w.sparse[id] {
+		return nil
+	}
+
+	if t.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	payload := appendID(appendProducer(nil, producer), id)
+	_, err := t.log.Write(encodeBlock(payload))
+	if err != nil {
+		return fmt.Errorf("failed to write dedup log: %w", err)
+	}
+
+	if err := t.files.Appended(t.log); err != nil {
+		return err
+	}
+
+	crash.Point(crash.ProcessedAppend)
+
+	t.add(producer, id)
+	t.logged++
+
+	if t.logged >= t.options.CompactEvery {
+		return t.compact()
+	}
+
+	return nil
+}
+
+func (t *Tracker) add(producer string, id int64) {
+	w := t.window(producer)
+	if id <= w.watermark {
+		return
+	}
+
+	w.insert(id)
+	w.advance()
+
+	if len(w.sparse) > t.options.MaxSparse {
+		oldest := w.oldest()
+		if w.forced == 0 {
+			log.Printf("Too many out of order ids from producer %q, moving watermark from %d to %d", producer, w.watermark, oldest)
+		}
+		w.forced++
+		w.watermark = oldest
+		delete(w.sparse, oldest)
+		w.advance()
+		return
+	}
+
+	if w.forced > 0 && len(w.sparse) < t.options.MaxSparse {
+		log.Printf("Producer %q back under %d out of order ids, its watermark was moved %d times", producer, t.options.MaxSparse, w.forced)
+		w.forced = 0
+	}
+}
+
+func (w *window) insert(id int64) {
+	w.sparse[id] = true
+	heap.Push(&w.order, id)
+}
+
+// advance moves the watermark over the sparse ids that follow it, and drops
+// them from the heap.
+func (w *window) advance() {
+	for w.sparse[w.watermark+1] {
+		delete(w.sparse, w.watermark+1)
+		w.watermark++
+	}
+
+	for len(w.order) > 0 && w.order[0] <= w.watermark {
+		heap.Pop(&w.order)
+	}
+}
+
+// oldest returns the lowest sparse id.
+func (w *window) oldest() int64 {
+	return w.order[0]
+}
+
+// Compact writes a snapshot of every window and empties the log.
+func (t *Tracker) Compact() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.compact()
+}
+
+func (t *Tracker) compact() error {
+	if t.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	producers := make([]string, 0, len(t.producers))
+	for producer := range t.producers {
+		producers = append(producers, producer)
+	}
+	sort.Strings(producers)
+
+	err := t.files.WriteAtomic(filepath.Join(t.path, snapshotFile), func(file *os.File) error {
+		writer := bufio.NewWriter(file)
+
+		err := writeHeader(writer, kindSnapshot)
+		if err != nil {
+			return err
+		}
+
+		for _, producer := range producers {
+			w := t.producers[producer]
+
+			ids := make([]int64, 0, len(w.sparse))
+			for id := range w.sparse {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+			payload := appendID(appendProducer(nil, producer), w.watermark)
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(ids)))
+			for _, id := range ids {
+				payload = appendID(payload, id)
+			}
+
+			if _, err := writer.Write(encodeBlock(payload)); err != nil {
+				return err
+			}
+		}
+
+		return writer.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write dedup snapshot: %w", err)
+	}
+
+	// The snapshot has to be on disk before the log it replaces is dropped.
+	err = t.files.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = t.log.Truncate(fileHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	t.logged = 0
+	return t.files.Appended(t.log)
+}
+
+// Len returns how many producers are tracked and how many out of order ids
+// are held in memory.
+func (t *Tracker) Len() (int, int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	sparse := 0
+	for _, w := range t.producers {
+		sparse += len(w.sparse)
+	}
+
+	return len(t.producers), sparse
+}
+
+// Torn returns the torn log tail found on open, if any. It was truncated away
+// unless the tracker is read only.
+func (t *Tracker) Torn() error {
+	return t.torn
+}
+
+// Each calls fn with the watermark and the sparse ids of every producer.
+func (t *Tracker) Each(fn func(producer string, watermark int64, sparse []int64)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for producer, w := range t.producers {
+		ids := make([]int64, 0, len(w.sparse))
+		for id := range w.sparse {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		fn(producer, w.watermark, ids)
+	}
+}
+
+// Sync makes every id added so far durable.
+func (t *Tracker) Sync() error {
+	return t.files.Sync()
+}
+
+func (t *Tracker) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.log == nil {
+		return nil
+	}
+
+	return t.log.Close()
+}
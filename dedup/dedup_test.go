@@ -0,0 +1,162 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func open(t *testing.T, path string, maxSparse int) *Tracker {
+	t.Helper()
+
+	tracker, err := Open(path, Options{MaxSparse: maxSparse, CompactEvery: DefaultCompactEvery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+// Past MaxSparse out of order ids the watermark moves up to the lowest of
+// them, taking the gap below it as processed.
+func TestMaxSparseMovesWatermarkToOldest(t *testing.T) {
+	tracker := open(t, t.TempDir(), 3)
+	defer tracker.Close()
+
+	for _, id := range []int64{1, 9, 5, 7, 11} {
+		if err := tracker.Add("p", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker.Each(func(producer string, watermark int64, sparse []int64) {
+		if watermark != 5 || len(sparse) != 3 {
+			t.Errorf("watermark %d and sparse %v, want 5 and 7, 9, 11", watermark, sparse)
+		}
+	})
+	for _, id := range []int64{2, 4, 5, 7} {
+		if !tracker.Contains("p", id) {
+			t.Errorf("%d not processed", id)
+		}
+	}
+	if tracker.Contains("p", 8) {
+		t.Error("8 processed")
+	}
+}
+
+// The ids the watermark moves over leave the heap, so it only holds the
+// sparse ones.
+func TestInOrderIdsLeaveTheHeap(t *testing.T) {
+	tracker := open(t, t.TempDir(), DefaultMaxSparse)
+	defer tracker.Close()
+
+	for _, id := range []int64{3, 1, 2, 4, 6} {
+		if err := tracker.Add("p", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := tracker.producers["p"]
+	if w.watermark != 4 || len(w.order) != 1 || w.order[0] != 6 {
+		t.Fatalf("watermark %d and heap %v, want 4 and 6", w.watermark, w.order)
+	}
+}
+
+// The sparse ids of a snapshot go back in the heap on open.
+func TestSnapshotRestoresHeap(t *testing.T) {
+	path := t.TempDir()
+	tracker := open(t, path, 2)
+	for _, id := range []int64{1, 5, 3} {
+		if err := tracker.Add("p", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tracker.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker = open(t, path, 2)
+	defer tracker.Close()
+
+	if err := tracker.Add("p", 9); err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.Contains("p", 2) || tracker.Contains("p", 4) {
+		t.Fatal("watermark not moved to the oldest sparse id of the snapshot")
+	}
+}
+
+// A torn block whose length runs past the end of the log is dropped like any
+// torn block, without allocating that length.
+func TestTornLengthPastLog(t *testing.T) {
+	path := t.TempDir()
+	tracker := open(t, path, DefaultMaxSparse)
+	if err := tracker.Add("p", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logPath := filepath.Join(path, logFile)
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header [blockHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], 0xFFFFFFF0)
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(header[:]); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	tracker = open(t, path, DefaultMaxSparse)
+	defer tracker.Close()
+
+	if tracker.Torn() == nil || !tracker.Contains("p", 1) {
+		t.Fatalf("torn %v, contains 1 %v", tracker.Torn(), tracker.Contains("p", 1))
+	}
+	truncated, err := os.Stat(logPath)
+	if err != nil || truncated.Size() != info.Size() {
+		t.Fatalf("log size %d after open, want %d: %v", truncated.Size(), info.Size(), err)
+	}
+}
+
+// A producer past MaxSparse is logged once when it overflows and once when
+// it has room again, not on every id.
+func TestMaxSparseLogsOnce(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	tracker := open(t, t.TempDir(), 3)
+	defer tracker.Close()
+
+	// every even id past the 3 sparse ones moves the watermark
+	for id := int64(2); id <= 40; id += 2 {
+		if err := tracker.Add("p", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the odd ids fill the gaps, the window drains
+	for id := int64(33); id <= 39; id += 2 {
+		if err := tracker.Add("p", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lines := strings.Count(out.String(), "\n"); lines != 2 {
+		t.Fatalf("logged %d lines, want 2:\n%s", lines, out.String())
+	}
+}
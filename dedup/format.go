@@ -0,0 +1,212 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Snapshot and log files share one layout, a header followed by blocks:
+//
+//	header  magic [4]byte "PIDS", version uint16, kind uint16
+//	block   length uint32, crc uint32, payload [length]byte
+//
+// The crc is the castagnoli checksum of the payload. Integers are big
+// endian. A log block holds one entry, a snapshot block one producer:
+//
+//	entry     producer, id int64
+//	producer  producer, watermark int64, count uint32, count * id int64
+//
+// where producer is a uint16 length followed by its bytes.
+var magic = [4]byte{'P', 'I', 'D', 'S'}
+
+const version = 1
+
+const (
+	kindSnapshot uint16 = 1
+	kindLog      uint16 = 2
+)
+
+const fileHeaderSize = 8
+const blockHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrFormat = errors.New("invalid processed ids file")
+
+var errTorn = errors.New("torn block")
+
+func writeHeader(w io.Writer, kind uint16) error {
+	var header [fileHeaderSize]byte
+	copy(header[0:4], magic[:])
+	binary.BigEndian.PutUint16(header[4:6], version)
+	binary.BigEndian.PutUint16(header[6:8], kind)
+
+	_, err := w.Write(header[:])
+	return err
+}
+
+func readHeader(r io.Reader, kind uint16) error {
+	var header [fileHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return fmt.Errorf("%w: short header", ErrFormat)
+	}
+
+	if [4]byte(header[0:4]) != magic {
+		return fmt.Errorf("%w: bad magic %q", ErrFormat, header[0:4])
+	}
+
+	if v := binary.BigEndian.Uint16(header[4:6]); v != version {
+		return fmt.Errorf("%w: unsupported version %d", ErrFormat, v)
+	}
+
+	if k := binary.BigEndian.Uint16(header[6:8]); k != kind {
+		return fmt.Errorf("%w: expected kind %d, found %d", ErrFormat, kind, k)
+	}
+
+	return nil
+}
+
+func encodeBlock(payload []byte) []byte {
+	block := make([]byte, blockHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(block[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(block[4:8], crc32.Checksum(payload, crcTable))
+	copy(block[blockHeaderSize:], payload)
+	return block
+}
+
+// readBlock returns the next block payload out of the remaining bytes of the
+// file, io.EOF at a clean end of file and errTorn when the block is short,
+// its length runs past the remaining bytes or its checksum does not match.
+func readBlock(r io.Reader, remaining int64) ([]byte, error) {
+	var header [blockHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errTorn
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if int64(length) > remaining-blockHeaderSize {
+		return nil, errTorn
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, errTorn
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errTorn
+	}
+
+	return payload, nil
+}
+
+func appendProducer(payload []byte, producer string) []byte {
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(producer)))
+	return append(payload, producer...)
+}
+
+func appendID(payload []byte, id int64) []byte {
+	return binary.BigEndian.AppendUint64(payload, uint64(id))
+}
+
+// decoder reads the fields of a block payload, remembering the first error.
+type decoder struct {
+	payload []byte
+	err     error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.payload) < n {
+		d.err = fmt.Errorf("%w: short block", ErrFormat)
+		return nil
+	}
+
+	field := d.payload[:n]
+	d.payload = d.payload[n:]
+	return field
+}
+
+func (d *decoder) producer() string {
+	length := d.take(2)
+	if length == nil {
+		return ""
+	}
+	return string(d.take(int(binary.BigEndian.Uint16(length))))
+}
+
+func (d *decoder) id() int64 {
+	field := d.take(8)
+	if field == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(field))
+}
+
+func (d *decoder) count() int {
+	field := d.take(4)
+	if field == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(field))
+}
+
+func (d *decoder) done() error {
+	if d.err == nil && len(d.payload) > 0 {
+		d.err = fmt.Errorf("%w: trailing bytes in block", ErrFormat)
+	}
+	return d.err
+}
+
+// MigrateLegacy adds to the tracker, under producer, the ids of a legacy
+// processed ids file: a headerless sequence of big endian int32. The file is
+// removed once its ids are in a snapshot. A missing file is not an error.
+func (t *Tracker) MigrateLegacy(path string, producer string) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	count := 0
+
+	var current int32
+	for {
+		err := binary.Read(reader, binary.BigEndian, &current)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		t.mutex.Lock()
+		t.add(producer, int64(current))
+		t.mutex.Unlock()
+		count++
+	}
+
+	err = t.Compact()
+	if err != nil {
+		return count, err
+	}
+
+	return count, os.Remove(path)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/middleware"
+)
+
+const usage = `usage: dlq <command> [flags]
+
+commands:
+  list       print the dead letters, leaving them in the queue
+  republish  send the dead letters back to their queue (-queue to only
+             republish the ones of a queue)
+`
+
+// errStop is returned by the fn of each to stop before the queue is idle.
+var errStop = errors.New("stop")
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands := map[string]func(args []string) error{
+		"list":      list,
+		"republish": republish,
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	err := command(os.Args[2:])
+	if err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+type options struct {
+	url  string
+	idle time.Duration
+}
+
+// flags returns the flag set of a command, with the flags every command
+// shares.
+func flags(name string, opts *options) *flag.FlagSet {
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&opts.url, "url", middleware.DefaultURL, "URL of the RabbitMQ server")
+	set.DurationVar(&opts.idle, "idle", 2*time.Second, "stop after waiting this long for a dead letter")
+	return set
+}
+
+func connect(url string) (*middleware.Middleware, error) {
+	broker, err := middleware.DialAMQP(url, middleware.AMQPOptions{Confirms: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return middleware.NewMiddlewareWithBroker(broker)
+}
+
+// each hands the dead letters to fn until none arrives for idle, or fn
+// returns errStop.
+func each(m *middleware.Middleware, idle time.Duration, fn func(letter *middleware.DeadLetter) error) error {
+	queue, err := m.ListenDeadLetters()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	letters := make(chan *middleware.DeadLetter)
+	result := make(chan error, 1)
+	go func() {
+		result <- queue.Consume(ctx, func(letter *middleware.DeadLetter) error {
+			select {
+			case letters <- letter:
+				return nil
+			case <-ctx.Done():
+				return nil
+			}
+		})
+	}()
+
+	for {
+		select {
+		case letter := <-letters:
+			err := fn(letter)
+			if errors.Is(err, errStop) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		case err := <-result:
+			return err
+		case <-time.After(idle):
+			return nil
+		}
+	}
+}
+
+// list prints the dead letters without acking them, so closing the
+// connection puts them back. At most middleware.DefaultPrefetch are listed,
+// the broker hands no more to a consumer that holds them unacked.
+func list(args []string) error {
+	var opts options
+	set := flags("list", &opts)
+	set.Parse(args)
+
+	m, err := connect(opts.url)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	count := 0
+	err = each(m, opts.idle, func(letter *middleware.DeadLetter) error {
+		count++
+
+		failedAt := "-"
+		if !letter.FailedAt.IsZero() {
+			failedAt = letter.FailedAt.Format(time.RFC3339)
+		}
+		id := letter.MessageId
+		if id == "" {
+			id = "-"
+		}
+		fmt.Printf("%s\tid=%s\tattempts=%d\tfailed=%s\tsize=%d\ttype=%s\t%s\n", letter.Queue, id, letter.Attempts, failedAt, len(letter.Body), letter.ContentType, letter.Reason)
+
+		if count == middleware.DefaultPrefetch {
+			return errStop
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d dead letters listed\n", count)
+	return nil
+}
+
+// republish sends the dead letters back to the queue they failed in. The ones
+// of other queues are left unacked, and put back when the connection closes.
+func republish(args []string) error {
+	var opts options
+	set := flags("republish", &opts)
+	queue := set.String("queue", "", "only republish the dead letters of this queue")
+	set.Parse(args)
+
+	m, err := connect(opts.url)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	republished, skipped := 0, 0
+	err = each(m, opts.idle, func(letter *middleware.DeadLetter) error {
+		if letter.Queue == "" || (*queue != "" && letter.Queue != *queue) {
+			skipped++
+			return nil
+		}
+
+		err := m.Republish(letter)
+		if err != nil {
+			return err
+		}
+
+		republished++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d dead letters republished, %d skipped\n", republished, skipped)
+	return nil
+}
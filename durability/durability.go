@@ -0,0 +1,253 @@
+package durability
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/LucasAlda/demo-falopa/crash"
+)
+
+// Level says how hard the database tries to keep acknowledged writes across
+// a power loss. Every level survives a process crash, since the page cache
+// outlives the process.
+//
+//   - None never calls fsync. A power loss may lose acknowledged updates.
+//   - Commit fsyncs every WAL commit record before the commit returns, and
+//     every rewritten file before it is renamed in place, so a file is never
+//     replaced by an empty one. Directories and appended files are synced at
+//     checkpoints, and a commit is only marked applied in the WAL after the
+//     checkpoint that made its writes durable, so a power loss is recovered
+//     by replaying the WAL.
+//   - Full also fsyncs the directory after every rename, every append, and
+//     the applied marker of every commit. Nothing but the in-flight commit is
+//     left to replay after a power loss.
+type Level int
+
+const (
+	None Level = iota
+	Commit
+	Full
+)
+
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "none":
+		return None, nil
+	case "commit", "":
+		return Commit, nil
+	case "full":
+		return Full, nil
+	}
+
+	return None, fmt.Errorf("unknown durability level: %s", name)
+}
+
+func (l Level) String() string {
+	switch l {
+	case None:
+		return "none"
+	case Commit:
+		return "commit"
+	case Full:
+		return "full"
+	}
+
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// SyncDir fsyncs a directory, making the renames, creations and removals of
+// its entries durable.
+func SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// SyncFile fsyncs the file at path.
+func SyncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// tempPattern matches the temp files created by WriteAtomic, the target name
+// followed by the random suffix of os.CreateTemp.
+var tempPattern = regexp.MustCompile(`\.[0-9]+\.tmp$`)
+
+// TempFile is a temp file left behind by a WriteAtomic that never got to its
+// rename.
+type TempFile struct {
+	Path   string
+	Target string
+	Size   int64
+}
+
+// FindTemp lists every WriteAtomic temp file under root. They are never
+// needed for recovery: the rename they were waiting for either happened, or
+// the target still holds its previous complete version.
+func FindTemp(root string) ([]TempFile, error) {
+	var temps []TempFile
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || !tempPattern.MatchString(entry.Name()) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		temps = append(temps, TempFile{
+			Path:   path,
+			Target: tempPattern.ReplaceAllString(path, ""),
+			Size:   info.Size(),
+		})
+		return nil
+	})
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	return temps, err
+}
+
+// Files writes and removes files following a durability level. At Full every
+// change is synced before it returns, at Commit the changed directories and
+// appended files are remembered and synced by the next call to Sync.
+type Files struct {
+	mutex sync.Mutex
+	level Level
+	dirty map[string]bool
+	dirs  map[string]bool
+}
+
+func NewFiles(level Level) *Files {
+	return &Files{level: level, dirty: make(map[string]bool), dirs: make(map[string]bool)}
+}
+
+func (f *Files) Level() Level {
+	return f.level
+}
+
+// WriteAtomic writes a file by calling write on a temp file next to it and
+// renaming it over path, so readers never see it half written.
+func (f *Files) WriteAtomic(path string, write func(file *os.File) error) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	err = write(tmpFile)
+	if err == nil && f.level >= Commit {
+		err = tmpFile.Sync()
+	}
+
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	crash.Point(crash.TempWrite)
+
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	crash.Point(crash.Rename)
+
+	return f.changed(path)
+}
+
+// Remove removes path. A missing file is not an error.
+func (f *Files) Remove(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.changed(path)
+}
+
+// Appended records that data was appended to the open file.
+func (f *Files) Appended(file *os.File) error {
+	switch f.level {
+	case Full:
+		return file.Sync()
+	case Commit:
+		f.mutex.Lock()
+		f.dirty[file.Name()] = true
+		f.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// Created records that the file at path was created.
+func (f *Files) Created(path string) error {
+	return f.changed(path)
+}
+
+func (f *Files) changed(path string) error {
+	switch f.level {
+	case Full:
+		return SyncDir(filepath.Dir(path))
+	case Commit:
+		f.mutex.Lock()
+		f.dirs[filepath.Dir(path)] = true
+		f.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// Sync fsyncs every file and directory changed since the last Sync.
+func (f *Files) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for path := range f.dirty {
+		err := SyncFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(f.dirty, path)
+	}
+
+	for dir := range f.dirs {
+		if err := SyncDir(dir); err != nil {
+			return err
+		}
+		delete(f.dirs, dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package durability
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func keys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// None syncs nothing, Commit remembers the appended files and changed
+// directories until Sync, Full syncs them before returning.
+func TestFilesLevels(t *testing.T) {
+	tests := []struct {
+		level Level
+		// pending says whether the changes wait for Sync.
+		pending bool
+	}{
+		{None, false},
+		{Commit, true},
+		{Full, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.level.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			files := NewFiles(test.level)
+
+			path := filepath.Join(dir, "data")
+			err := files.WriteAtomic(path, func(file *os.File) error {
+				_, err := file.WriteString("a\n")
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			appended, err := os.OpenFile(filepath.Join(dir, "log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer appended.Close()
+
+			if _, err := appended.WriteString("b\n"); err != nil {
+				t.Fatal(err)
+			}
+			if err := files.Appended(appended); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.pending {
+				if !files.dirs[dir] || len(files.dirs) != 1 {
+					t.Errorf("dirs to sync = %v, want only %s", keys(files.dirs), dir)
+				}
+				if !files.dirty[appended.Name()] || len(files.dirty) != 1 {
+					t.Errorf("files to sync = %v, want only %s", keys(files.dirty), appended.Name())
+				}
+			} else if len(files.dirs) != 0 || len(files.dirty) != 0 {
+				t.Errorf("left to sync dirs %v and files %v, want nothing", keys(files.dirs), keys(files.dirty))
+			}
+
+			if err := files.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if len(files.dirs) != 0 || len(files.dirty) != 0 {
+				t.Errorf("left to sync after Sync dirs %v and files %v", keys(files.dirs), keys(files.dirty))
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != "a\n" {
+				t.Fatalf("written file = %q, %v", data, err)
+			}
+			temps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+			if err != nil || len(temps) != 0 {
+				t.Fatalf("temp files left %v, %v", temps, err)
+			}
+		})
+	}
+}
+
+// Removing a missing file is not a change to sync.
+func TestFilesRemoveMissing(t *testing.T) {
+	files := NewFiles(Commit)
+
+	if err := files.Remove(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatal(err)
+	}
+	if len(files.dirs) != 0 {
+		t.Errorf("dirs to sync = %v, want none", keys(files.dirs))
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{None, Commit, Full} {
+		parsed, err := ParseLevel(level.String())
+		if err != nil || parsed != level {
+			t.Errorf("ParseLevel(%q) = %v, %v", level.String(), parsed, err)
+		}
+	}
+
+	if level, err := ParseLevel(""); err != nil || level != Commit {
+		t.Errorf("ParseLevel(\"\") = %v, %v, want commit", level, err)
+	}
+	if _, err := ParseLevel("always"); err == nil {
+		t.Error("ParseLevel(\"always\") succeeded")
+	}
+}
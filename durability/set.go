@@ -0,0 +1,111 @@
+package durability
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Set is a set of strings kept in an append-only file, one escaped entry per
+// line. Every Add is synced before it returns, whatever the level. A torn
+// last line is dropped on open, its Add never returned.
+type Set struct {
+	mutex   sync.Mutex
+	path    string
+	files   *Files
+	file    *os.File
+	entries map[string]bool
+}
+
+func OpenSet(path string) (*Set, error) {
+	s := &Set{path: path, files: NewFiles(Full), entries: make(map[string]bool)}
+
+	data, err := os.ReadFile(path)
+	created := errors.Is(err, os.ErrNotExist)
+	if err != nil && !created {
+		return nil, err
+	}
+
+	valid := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range bytes.Split(data[:valid], []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := url.PathUnescape(string(line))
+		if err != nil {
+			return nil, err
+		}
+		s.entries[entry] = true
+	}
+
+	if valid < len(data) {
+		err = os.Truncate(path, int64(valid))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		err = s.files.Created(path)
+		if err != nil {
+			s.file.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Set) Contains(entry string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.entries[entry]
+}
+
+// Entries returns every entry of the set.
+func (s *Set) Entries() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := make([]string, 0, len(s.entries))
+	for entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (s *Set) Add(entry string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.entries[entry] {
+		return nil
+	}
+
+	_, err := s.file.WriteString(url.PathEscape(entry) + "\n")
+	if err != nil {
+		return err
+	}
+
+	err = s.files.Appended(s.file)
+	if err != nil {
+		return err
+	}
+
+	s.entries[entry] = true
+	return nil
+}
+
+func (s *Set) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.file.Close()
+}
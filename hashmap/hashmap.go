@@ -0,0 +1,361 @@
+package hashmap
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/LucasAlda/demo-falopa/crash"
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+const metaFile = "meta.csv"
+
+// compactSlack is how many rows a bucket holds besides twice its live keys
+// before it is compacted, so a bucket of a few keys is not rewritten every
+// other write.
+const compactSlack = 64
+
+var ErrReadOnly = errors.New("hashmap opened read only")
+
+type Options struct {
+	// Durability says how writes are synced.
+	Durability durability.Level
+	// ReadOnly opens the hashmap without changing it: nothing is created,
+	// a missing hashmap reads as empty, and every write fails.
+	ReadOnly bool
+}
+
+// HashMap is an on-disk hashmap. Keys are spread over a fixed number of
+// bucket files, each one an append-only CSV file. A write appends a
+// `key,value...` row, the last one of a key wins, and a delete appends a row
+// with the key alone. A crash in the middle of an append leaves a torn last
+// row, cut before the newline that ends it, which is ignored and truncated
+// away by the next write. Once a bucket holds too many dead rows it is rewritten into a temp file,
+// with a row per live key, and renamed over the old one.
+type HashMap struct {
+	path     string
+	buckets  int
+	files    *durability.Files
+	readOnly bool
+}
+
+// Open opens the hashmap stored in path, creating it with the given number of
+// buckets if it does not exist yet. An existing hashmap keeps the bucket count
+// it was created with.
+func Open(path string, buckets int, options Options) (*HashMap, error) {
+	if buckets <= 0 {
+		return nil, fmt.Errorf("invalid bucket count: %d", buckets)
+	}
+
+	if !options.ReadOnly {
+		err := os.MkdirAll(path, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h := &HashMap{path: path, files: durability.NewFiles(options.Durability), readOnly: options.ReadOnly}
+
+	var err error
+	h.buckets, err = readMeta(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.buckets == 0 && options.ReadOnly {
+		h.buckets = buckets
+	} else if h.buckets == 0 {
+		err = h.writeAtomic(filepath.Join(path, metaFile), [][]string{{"buckets", strconv.Itoa(buckets)}})
+		if err != nil {
+			return nil, err
+		}
+		h.buckets = buckets
+	}
+
+	return h, nil
+}
+
+func readMeta(path string) (int, error) {
+	file, err := os.Open(filepath.Join(path, metaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	record, err := csv.NewReader(file).Read()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read hashmap meta: %w", err)
+	}
+
+	if len(record) != 2 || record[0] != "buckets" {
+		return 0, fmt.Errorf("invalid hashmap meta: %v", record)
+	}
+
+	return strconv.Atoi(record[1])
+}
+
+// Buckets returns the number of bucket files of the hashmap.
+func (h *HashMap) Buckets() int {
+	return h.buckets
+}
+
+// BucketPath returns the path of the bucket file holding key.
+func (h *HashMap) BucketPath(key string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return h.bucketFile(int(hash.Sum32() % uint32(h.buckets)))
+}
+
+func (h *HashMap) bucketFile(bucket int) string {
+	return filepath.Join(h.path, fmt.Sprintf("bucket-%04d.csv", bucket))
+}
+
+// Get returns the value stored for key, and whether it was found.
+func (h *HashMap) Get(key string) ([]string, bool, error) {
+	b, err := readBucket(h.BucketPath(key))
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, ok := b.values[key]
+	return value, ok, nil
+}
+
+// Put stores value under key, replacing any previous value.
+func (h *HashMap) Put(key string, value []string) error {
+	return h.Update(key, func([]string, bool) []string {
+		return value
+	})
+}
+
+// Update reads the current value of key and replaces it with the one returned
+// by update. ok is false if the key was not present. A value needs at least
+// one field, a row with the key alone deletes it.
+func (h *HashMap) Update(key string, update func(value []string, ok bool) []string) error {
+	path := h.BucketPath(key)
+
+	b, err := readBucket(path)
+	if err != nil {
+		return err
+	}
+
+	value, ok := b.values[key]
+	value = update(value, ok)
+	if len(value) == 0 {
+		return fmt.Errorf("empty value for key %s", key)
+	}
+
+	return h.write(path, b, append([]string{key}, value...))
+}
+
+// Delete removes key from the hashmap. Deleting a missing key is not an error.
+func (h *HashMap) Delete(key string) error {
+	path := h.BucketPath(key)
+
+	b, err := readBucket(path)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := b.values[key]; !ok {
+		return nil
+	}
+
+	return h.write(path, b, []string{key})
+}
+
+// Iterate calls fn for every key in the hashmap, bucket by bucket, stopping
+// at the first error.
+func (h *HashMap) Iterate(fn func(key string, value []string) error) error {
+	for bucket := range h.buckets {
+		b, err := readBucket(h.bucketFile(bucket))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range b.keys {
+			if err := fn(key, b.values[key]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// bucket is what a bucket file holds once its rows are replayed.
+type bucket struct {
+	exists bool
+	// keys are the live keys, in the order they were first written.
+	keys   []string
+	values map[string][]string
+	rows   int
+	// valid is the size of the complete rows, any byte after them is the
+	// torn tail of an interrupted append.
+	valid int64
+	size  int64
+}
+
+func readBucket(path string) (*bucket, error) {
+	b := &bucket{values: make(map[string][]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b.exists = true
+	b.size = int64(len(data))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+
+	// a row is complete once the newline after it is written, its quoted
+	// fields may hold newlines of their own. A torn row fails to parse only
+	// at the end of the file, an error before it is a corrupt bucket.
+	var records [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		offset := reader.InputOffset()
+		if err != nil && offset < b.size {
+			return nil, fmt.Errorf("failed to read bucket %s: %w", path, err)
+		}
+		if err != nil || data[offset-1] != '\n' {
+			break
+		}
+
+		records = append(records, record)
+		b.valid = offset
+	}
+
+	deleted := false
+	for _, record := range records {
+		key := record[0]
+		if len(record) == 1 {
+			if _, ok := b.values[key]; ok {
+				delete(b.values, key)
+				deleted = true
+			}
+			continue
+		}
+
+		if _, ok := b.values[key]; !ok {
+			b.keys = append(b.keys, key)
+		}
+		b.values[key] = record[1:]
+	}
+	b.rows = len(records)
+
+	if deleted {
+		live := b.keys[:0]
+		for _, key := range b.keys {
+			if _, ok := b.values[key]; ok {
+				live = append(live, key)
+			}
+		}
+		b.keys = live
+	}
+
+	return b, nil
+}
+
+// write appends record to the bucket b read from path, or compacts the bucket
+// with it once the bucket holds compactSlack more rows than twice its live
+// keys.
+func (h *HashMap) write(path string, b *bucket, record []string) error {
+	if h.readOnly {
+		return ErrReadOnly
+	}
+
+	if b.rows+1 > 2*len(b.values)+compactSlack {
+		return h.compact(path, b, record)
+	}
+
+	if b.valid < b.size {
+		err := os.Truncate(path, b.valid)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write(record)
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	crash.Point(crash.StoreAppend)
+
+	if err := h.files.Appended(file); err != nil {
+		return err
+	}
+
+	if !b.exists {
+		return h.files.Created(path)
+	}
+	return nil
+}
+
+// compact rewrites the bucket with a single row per live key, record
+// included.
+func (h *HashMap) compact(path string, b *bucket, record []string) error {
+	key := record[0]
+	if len(record) == 1 {
+		delete(b.values, key)
+	} else {
+		if _, ok := b.values[key]; !ok {
+			b.keys = append(b.keys, key)
+		}
+		b.values[key] = record[1:]
+	}
+
+	records := make([][]string, 0, len(b.values))
+	for _, key := range b.keys {
+		if value, ok := b.values[key]; ok {
+			records = append(records, append([]string{key}, value...))
+		}
+	}
+
+	return h.writeAtomic(path, records)
+}
+
+func (h *HashMap) writeAtomic(path string, records [][]string) error {
+	if h.readOnly {
+		return ErrReadOnly
+	}
+
+	return h.files.WriteAtomic(path, func(file *os.File) error {
+		writer := csv.NewWriter(file)
+		writer.WriteAll(records)
+		return writer.Error()
+	})
+}
+
+// Sync makes every write done so far durable. It only has work to do at the
+// Commit durability level, the others sync as they write or never.
+func (h *HashMap) Sync() error {
+	return h.files.Sync()
+}
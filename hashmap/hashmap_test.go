@@ -0,0 +1,190 @@
+package hashmap
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+func open(t *testing.T, path string) *HashMap {
+	t.Helper()
+
+	h, err := Open(path, 1, Options{Durability: durability.None})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func get(t *testing.T, h *HashMap, key string) (string, bool) {
+	t.Helper()
+
+	value, ok, err := h.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		return "", false
+	}
+	return value[0], true
+}
+
+// An update appends to the bucket in place instead of renaming a new one
+// over it.
+func TestUpdateAppends(t *testing.T) {
+	h := open(t, t.TempDir())
+	path := h.BucketPath("k")
+
+	if err := h.Put("k", []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Put("k", []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !os.SameFile(before, after) || after.Size() <= before.Size() {
+		t.Fatalf("bucket replaced or not grown: %d then %d bytes", before.Size(), after.Size())
+	}
+	if value, _ := get(t, h, "k"); value != "2" {
+		t.Fatalf("k = %q, want 2", value)
+	}
+}
+
+// A bucket with too many dead rows is compacted to a row per live key, and
+// keeps the last value of every key and none of the deleted ones.
+func TestCompaction(t *testing.T) {
+	h := open(t, t.TempDir())
+
+	for i := range 200 {
+		if err := h.Put("k", []string{strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Put("gone", []string{"x"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Delete("gone"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := readBucket(h.BucketPath("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.rows > 2*len(b.values)+compactSlack {
+		t.Fatalf("bucket holds %d rows for %d keys, not compacted", b.rows, len(b.values))
+	}
+
+	if value, _ := get(t, h, "k"); value != "199" {
+		t.Fatalf("k = %q after compaction, want 199", value)
+	}
+	if _, ok := get(t, h, "gone"); ok {
+		t.Fatal("deleted key back after compaction")
+	}
+}
+
+// A torn last row is ignored and truncated away by the next write.
+func TestTornAppend(t *testing.T) {
+	h := open(t, t.TempDir())
+	path := h.BucketPath("k")
+
+	if err := os.WriteFile(path, []byte("k,1\nk,2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := get(t, h, "k"); value != "1" {
+		t.Fatalf("k = %q with a torn tail, want 1", value)
+	}
+
+	if err := h.Put("other", []string{"3"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "k,1\nother,3\n" {
+		t.Fatalf("bucket = %q, %v", data, err)
+	}
+}
+
+// A bucket written with a row per key, as before appends, reads the same.
+func TestReadsRewrittenBuckets(t *testing.T) {
+	path := t.TempDir()
+	h := open(t, path)
+
+	if err := os.WriteFile(filepath.Join(path, "bucket-0000.csv"), []byte("a,1\nb,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	err := h.Iterate(func(key string, value []string) error {
+		got[key] = value[0]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["a"] != "1" || got["b"] != "2" {
+		t.Fatalf("iterated %v", got)
+	}
+}
+
+// A value holding newlines survives the append after it, and a row torn
+// inside its quoted field is dropped whole.
+func TestNewlinesInValues(t *testing.T) {
+	h := open(t, t.TempDir())
+	path := h.BucketPath("k")
+
+	if err := h.Put("k", []string{"two\nlines"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// torn after the newline inside the quotes
+	torn := append(data, "other,\"a\n"...)
+	if err := os.WriteFile(path, torn, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := get(t, h, "k"); value != "two\nlines" {
+		t.Fatalf("k = %q, want two\\nlines", value)
+	}
+	if _, ok := get(t, h, "other"); ok {
+		t.Fatal("torn row read")
+	}
+
+	if err := h.Put("other", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := get(t, h, "k"); value != "two\nlines" {
+		t.Fatalf("k = %q after an append, want two\\nlines", value)
+	}
+	if value, _ := get(t, h, "other"); value != "b" {
+		t.Fatalf("other = %q, want b", value)
+	}
+}
+
+// A row that does not parse before the last one is a corrupt bucket, not a
+// torn tail to cut.
+func TestCorruptRowFails(t *testing.T) {
+	h := open(t, t.TempDir())
+	path := h.BucketPath("k")
+
+	if err := os.WriteFile(path, []byte("k,1\nj,\"x\"y\nk,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := h.Get("k"); err == nil {
+		t.Fatal("corrupt bucket read")
+	}
+}
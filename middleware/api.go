@@ -1,21 +1,15 @@
 package middleware
 
 import (
-	"bytes"
-	"encoding/gob"
 	"log"
 	"strconv"
 	"strings"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func (m *Middleware) declare() error {
-	gob.Register(Query1Result{})
-	gob.Register(Query2Result{})
-	gob.Register(Query3Result{})
-	gob.Register(Query4Result{})
-	gob.Register(Query5Result{})
+	if err := m.declareDeadLetters(); err != nil {
+		return err
+	}
 
 	if err := m.declareGamesExchange(); err != nil {
 		return err
@@ -37,386 +31,188 @@ func (m *Middleware) declare() error {
 		return err
 	}
 
+	m.declarePublishers()
+
 	return nil
 }
 
 func (m *Middleware) declareGamesExchange() error {
-	err := m.channel.ExchangeDeclare(
-		"games",
-		"topic",
-		true,  // durable
-		false, // auto-deleted
-		false, // internal
-		false, // no-wait
-		nil,   // arguments
-	)
-
+	err := m.broker.DeclareExchange("games")
 	if err != nil {
-		log.Fatalf("Failed to declare exchange: %v", err)
-		return err
+		return &TopologyError{Kind: "exchange", Name: "games", Err: err}
 	}
 
 	return nil
 }
 
 func (m *Middleware) declareReviewsQueue() error {
-	queue, err := m.channel.QueueDeclare(
-		"reviews", // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
-	log.Printf("Declared queue: %v", queue.Name)
-	m.reviewsQueue = &queue
-
+	m.reviewsQueue = "reviews"
+	err := m.broker.DeclareQueue(m.reviewsQueue, QueueOptions{DeadLetterExchange: DeadLettersExchange})
 	if err != nil {
-		log.Fatalf("Failed to declare queue: %v", err)
-		return err
+		return &TopologyError{Kind: "queue", Name: m.reviewsQueue, Err: err}
 	}
+	log.Printf("Declared queue: %v", m.reviewsQueue)
 
 	return nil
 }
 
 func (m *Middleware) declareStatsExchange() error {
-	err := m.channel.ExchangeDeclare(
-		"stats",
-		"topic",
-		true,  // durable
-		false, // auto-deleted
-		false, // internal
-		false, // no-wait
-		nil,   // arguments
-	)
-
+	err := m.broker.DeclareExchange("stats")
 	if err != nil {
-		log.Fatalf("Failed to declare exchange: %v", err)
-		return err
+		return &TopologyError{Kind: "exchange", Name: "stats", Err: err}
 	}
 
 	return nil
 }
 
 func (m *Middleware) declareResultsExchange() error {
-	err := m.channel.ExchangeDeclare(
-		"results",
-		"topic",
-		true,  // durable
-		false, // auto-deleted
-		false, // internal
-		false, // no-wait
-		nil,   // arguments
-	)
+	err := m.broker.DeclareExchange("results")
 	if err != nil {
-		log.Fatalf("Failed to declare results exchange: %v", err)
-		return err
+		return &TopologyError{Kind: "exchange", Name: "results", Err: err}
 	}
 	return nil
 }
 
 func (m *Middleware) DeclareResponsesQueue() error {
-	queue, err := m.channel.QueueDeclare(
-		"responses", // name
-		true,        // durable
-		false,       // delete when unused
-		false,       // exclusive
-		false,       // no-wait
-		nil,         // arguments
-	)
-	m.responsesQueue = &queue
-
+	m.responsesQueue = "responses"
+	err := m.broker.DeclareQueue(m.responsesQueue, QueueOptions{DeadLetterExchange: DeadLettersExchange})
 	if err != nil {
-		log.Fatalf("Failed to declare queue: %v", err)
-		return err
+		return &TopologyError{Kind: "queue", Name: m.responsesQueue, Err: err}
 	}
 
 	return nil
 }
 
-func (m *Middleware) ListenGames(shardId string) (*GamesQueue, error) {
-	queue, err := m.bindExchange("games", shardId)
-	if err != nil {
-		return nil, err
-	}
-
-	return &GamesQueue{queue: queue, middleware: m}, nil
+func (m *Middleware) ListenGames(shardId string) (*Queue[GameMsg], error) {
+	return ListenQueue[GameMsg](m, "games", shardId, &EndOfStream{
+		Producers: m.expectedProducers(StreamGames),
+		Consumers: 1,
+	})
 }
 
 func (m *Middleware) SendGameMsg(message *GameMsg) error {
-	totalInt := 0
-	for _, char := range strconv.Itoa(message.Game.AppId) {
-		int, _ := strconv.Atoi(string(char))
-		totalInt += int
-	}
-	shardId := totalInt % 3
-	stringShardId := strconv.Itoa(shardId)
-
-	return m.publishExchange("games", stringShardId, message)
+	return m.games.Publish(message)
 }
 
-func (m Middleware) SendGameFinished() error {
-
-	for shardId := range 3 {
-		stringShardId := strconv.Itoa(shardId)
-		err := m.publishExchange("games", stringShardId, &GameMsg{Game: &Game{}, Last: true})
-		if err != nil {
-			log.Fatalf("Failed to send game finished to shard %s: %v", stringShardId, err)
-			return err
-		}
-	}
-
-	return nil
+// SendGameMsgsAndWait sends the messages and waits for the broker to take
+// every one of them, see Publisher.PublishAllAndWait.
+func (m *Middleware) SendGameMsgsAndWait(messages []*GameMsg) error {
+	return m.games.PublishAllAndWait(messages)
 }
 
-type GamesQueue struct {
-	queue      *amqp.Queue
-	middleware *Middleware
+// SendGameFinished sends the end of stream of the process for a client to
+// every games shard.
+func (m *Middleware) SendGameFinished(clientId string) error {
+	return m.broadcastEOF("games", clientId, func(shardId string) string {
+		return shardId
+	})
 }
 
-func (gq *GamesQueue) Consume(callback func(message *GameMsg, ack func()) error) error {
-	msgs, err := gq.middleware.consumeQueue(gq.queue)
+// ListenReviews returns the reviews queue, shared by the mappers, one per
+// shard. Each mapper sends the end of the stats of a client once it got the
+// end of stream of every reviews producer for it, unless OnEnd replaces it.
+func (m *Middleware) ListenReviews() (*Queue[ReviewsBatch], error) {
+	queue, err := ListenQueue[ReviewsBatch](m, "", m.reviewsQueue, &EndOfStream{
+		Producers: m.expectedProducers(StreamReviews),
+		Consumers: m.partitioner.Shards(),
+	})
 	if err != nil {
-		return err
-	}
-
-	for msg := range msgs {
-		var res GameMsg
-
-		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
-		err := decoder.Decode(&res)
-		if err != nil {
-			log.Fatalf("Failed to decode message: %v", err)
-			continue
-		}
-
-		if res.Last {
-			msg.Ack(false)
-			log.Println("LAST GAME")
-			break
-		}
-
-		callback(&res, func() {
-			msg.Ack(false)
-		})
+		return nil, err
 	}
 
-	return nil
-}
-
-func (m *Middleware) ListenReviews() (*ReviewsQueue, error) {
-	return &ReviewsQueue{queue: m.reviewsQueue, middleware: m}, nil
+	queue.OnEnd(m.SendStatsFinished)
+	return queue, nil
 }
 
 func (m *Middleware) SendReviewBatch(message *ReviewsBatch) error {
-	return m.publishQueue(m.reviewsQueue, message)
+	return m.reviews.Publish(message)
 }
 
-func (m Middleware) SendReviewsFinished(last int) error {
-	if last == 3+1 {
-		log.Println("ALL SHARDS SENT STATS, SENDING STATS FINISHED")
-		return m.SendStatsFinished()
-	}
-	log.Printf("Another mapper finished %d", last)
-	return m.publishQueue(m.reviewsQueue, &ReviewsBatch{Last: last})
+// SendReviewBatchAndWait sends the message and waits for the broker to take
+// it, see Publisher.PublishAndWait.
+func (m *Middleware) SendReviewBatchAndWait(message *ReviewsBatch) error {
+	return m.reviews.PublishAndWait(message)
 }
 
-type ReviewsQueue struct {
-	queue      *amqp.Queue
-	middleware *Middleware
-	finished   bool
-}
-
-func (rq *ReviewsQueue) Consume(callback func(message *ReviewsBatch, ack func()) error) error {
-	msgs, err := rq.middleware.consumeQueue(rq.queue)
-	if err != nil {
-		return err
-	}
-
-	for msg := range msgs {
-		var res ReviewsBatch
-
-		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
-		err := decoder.Decode(&res)
-		if err != nil {
-			log.Fatalf("Failed to decode message: %v", err)
-			continue
-		}
-
-		if res.Last > 0 {
-			log.Println("Received Last message: %v", res.Last)
-			if !rq.finished {
-				rq.middleware.SendReviewsFinished(res.Last + 1)
-				rq.finished = true
-				msg.Ack(false)
-				continue
-			} else {
-				log.Println("Received Last again, ignoring and NACKing...")
-				msg.Nack(false, true)
-				// continue
-				break
-			}
-		}
-
-		callback(&res, func() {
-			msg.Ack(false)
-		})
-	}
-
-	return nil
+// SendReviewsFinished sends the end of stream of the process for a client to
+// the reviews queue.
+func (m *Middleware) SendReviewsFinished(clientId string) error {
+	return m.sendEOF("", m.reviewsQueue, clientId)
 }
 
 func (m *Middleware) SendStats(message *StatsMsg) error {
-	// totalInt := 0
-	// for _, char := range strconv.Itoa(message.Stats.AppId) {
-	// 	int, _ := strconv.Atoi(string(char))
-	// 	totalInt += int
-	// }
-	shardId := 1
-	topic := strconv.Itoa(shardId) + "." + strings.Join(message.Stats.Genres, ".")
-
-	return m.publishExchange("stats", topic, message)
+	return m.stats.Publish(message)
 }
 
-func (m *Middleware) SendStatsFinished() error {
-	for shardId := range 3 {
-		stringShardId := strconv.Itoa(shardId)
-		topic := stringShardId + ".Indie.Action"
-		err := m.publishExchange("stats", topic, &StatsMsg{Stats: &Stats{}, Last: true})
-		if err != nil {
-			log.Fatalf("Failed to send stats finished to shard %s: %v", topic, err)
-			return err
-		}
-	}
-	return nil
+// SendStatsFinished sends the end of stream of the process for a client to
+// every stats shard, on a key every genre queue of the shard is bound to.
+func (m *Middleware) SendStatsFinished(clientId string) error {
+	return m.broadcastEOF("stats", clientId, func(shardId string) string {
+		return shardId + "." + eofWord
+	})
 }
 
-type StatsQueue struct {
-	queue      *amqp.Queue
-	middleware *Middleware
-}
-
-func (m *Middleware) ListenStats(shardId string, genre string) (*StatsQueue, error) {
-	queue, err := m.bindExchange("stats", shardId+".#."+genre+".#")
+// ListenStats returns the stats queue of a shard and genre, where the stream
+// of a client ends once every stats producer finished it.
+func (m *Middleware) ListenStats(shardId string, genre string) (*Queue[StatsMsg], error) {
+	queue, err := ListenQueue[StatsMsg](m, "stats", shardId+".#."+genre+".#", &EndOfStream{
+		Producers: m.expectedProducers(StreamStats),
+		Consumers: 1,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &StatsQueue{queue: queue, middleware: m}, nil
-}
-
-func (sq *StatsQueue) Consume(callback func(message *StatsMsg, ack func()) error) error {
-	msgs, err := sq.middleware.consumeQueue(sq.queue)
+	err = m.bindEOF(queue.name, "stats", shardId+"."+eofWord)
 	if err != nil {
-		return err
-	}
-
-	for msg := range msgs {
-		var res StatsMsg
-
-		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
-		err := decoder.Decode(&res)
-		if err != nil {
-			log.Fatalf("Failed to decode message: %v", err)
-			continue
-		}
-
-		callback(&res, func() {
-			msg.Ack(false)
-		})
+		return nil, err
 	}
 
-	return nil
+	return queue, nil
 }
 
-type ResultsQueue struct {
-	queue      *amqp.Queue
-	middleware *Middleware
-}
-
-func (m *Middleware) ListenResults(queryId string) (*ResultsQueue, error) {
-	queue, err := m.bindExchange("results", queryId+".#")
-	if err != nil {
-		return nil, err
-	}
-	return &ResultsQueue{queue: queue, middleware: m}, nil
+// ListenResults returns the results queue of a query, where the results of a
+// client end once every shard sent its end of stream for it.
+func (m *Middleware) ListenResults(queryId string) (*Queue[Result], error) {
+	return ListenQueue[Result](m, "results", queryId+".#", &EndOfStream{
+		Producers: m.expectedProducers(StreamResults),
+		Consumers: 1,
+	})
 }
 
 func (m *Middleware) SendResult(queryId string, result *Result) error {
-	log.Printf("Sending result from query %s", queryId)
+	log.Printf("Sending result from query %s of client %q", queryId, result.ClientId)
 	return m.publishExchange("results", queryId, result)
 }
 
-func (rq *ResultsQueue) Consume(callback func(message *Result, ack func()) error) error {
-	pendingFinalAnswers := 3
-	msgs, err := rq.middleware.consumeQueue(rq.queue)
-	if err != nil {
-		return err
-	}
-
-	for msg := range msgs {
-		var res Result
-
-		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
-		if err := decoder.Decode(&res); err != nil {
-			log.Fatalf("Failed to decode result message: %v", err)
-			continue
-		}
-
-		err = callback(&res, func() {
-			msg.Ack(false)
-		})
-
-		if err != nil {
-			log.Fatalf("Failed to process result message: %v", err)
-		}
-
-		if res.IsFinalMessage {
-			pendingFinalAnswers--
-		}
-
-		if pendingFinalAnswers == 0 {
-			break
-		}
-	}
-
-	return nil
+// SendResultsFinished sends the end of stream of the process for a client to
+// the results queue of a query.
+func (m *Middleware) SendResultsFinished(queryId string, clientId string) error {
+	return m.sendEOF("results", queryId+"."+eofWord, clientId)
 }
 
-type ResponsesQueue struct {
-	queue      *amqp.Queue
-	middleware *Middleware
-	finished   bool
-}
-
-func (m *Middleware) ListenResponses() (*ResponsesQueue, error) {
-	return &ResponsesQueue{queue: m.responsesQueue, middleware: m}, nil
+func (m *Middleware) ListenResponses() (*Queue[Result], error) {
+	return ListenQueue[Result](m, "", m.responsesQueue, nil)
 }
 
 func (m *Middleware) SendResponse(response *Result) error {
-	return m.publishQueue(m.responsesQueue, response)
-}
-
-func (rq *ResponsesQueue) Consume(callback func(message *Result, ack func()) error) error {
-	msgs, err := rq.middleware.consumeQueue(rq.queue)
-	if err != nil {
-		return err
-	}
-
-	for msg := range msgs {
-		var res Result
-
-		decoder := gob.NewDecoder(bytes.NewReader(msg.Body))
-		err := decoder.Decode(&res)
-		if err != nil {
-			log.Fatalf("Failed to decode message: %v", err)
-			continue
-		}
-
-		callback(&res, func() {
-			msg.Ack(false)
-		})
-	}
-
-	return nil
+	return m.responses.Publish(response)
+}
+
+// declarePublishers sets the publishers of the messages routed by their
+// content.
+func (m *Middleware) declarePublishers() {
+	m.games = NewPublisher(m, "games", func(message *GameMsg) string {
+		return strconv.Itoa(m.partitioner.Shard(strconv.Itoa(message.Game.AppId)))
+	})
+	m.reviews = NewPublisher(m, "", func(*ReviewsBatch) string {
+		return m.reviewsQueue
+	})
+	m.stats = NewPublisher(m, "stats", func(message *StatsMsg) string {
+		shardId := m.partitioner.Shard(strconv.Itoa(message.Stats.AppId))
+		return strconv.Itoa(shardId) + "." + strings.Join(message.Stats.Genres, ".")
+	})
+	m.responses = NewPublisher(m, "", func(*Result) string {
+		return m.responsesQueue
+	})
 }
@@ -0,0 +1,351 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var errShortBuffer = errors.New("binary: message ends early")
+
+// binaryCodec encodes the exported fields of structs in declaration order,
+// without names or types, so both ends must agree on the struct. Integers
+// are varints, floats 8 bytes, strings and slices are prefixed with their
+// length, pointers with whether they are nil, and interfaces with the name
+// their type was registered under with RegisterPayload.
+type binaryCodec struct{}
+
+func (binaryCodec) ContentType() string {
+	return ContentTypeBinary
+}
+
+func (binaryCodec) Encode(v interface{}) ([]byte, error) {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil, errors.New("binary: cannot encode nil pointer")
+		}
+		value = value.Elem()
+	}
+
+	var e binaryEncoder
+	err := e.encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return e.buffer, nil
+}
+
+func (binaryCodec) Decode(data []byte, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return errors.New("binary: decode needs a non-nil pointer")
+	}
+
+	d := binaryDecoder{data: data}
+	err := d.decode(value.Elem())
+	if err != nil {
+		return err
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("binary: %d bytes left after decoding", len(d.data))
+	}
+	return nil
+}
+
+type binaryEncoder struct {
+	buffer []byte
+}
+
+func (e *binaryEncoder) encode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buffer = append(e.buffer, 1)
+		} else {
+			e.buffer = append(e.buffer, 0)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.buffer = binary.AppendVarint(e.buffer, v.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.buffer = binary.AppendUvarint(e.buffer, v.Uint())
+
+	case reflect.Float32, reflect.Float64:
+		e.buffer = binary.LittleEndian.AppendUint64(e.buffer, math.Float64bits(v.Float()))
+
+	case reflect.String:
+		e.buffer = binary.AppendUvarint(e.buffer, uint64(v.Len()))
+		e.buffer = append(e.buffer, v.String()...)
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.buffer = binary.AppendUvarint(e.buffer, uint64(v.Len()))
+			e.buffer = append(e.buffer, v.Bytes()...)
+			return nil
+		}
+		e.buffer = binary.AppendUvarint(e.buffer, uint64(v.Len()))
+		return e.encodeElements(v)
+
+	case reflect.Array:
+		return e.encodeElements(v)
+
+	case reflect.Map:
+		e.buffer = binary.AppendUvarint(e.buffer, uint64(v.Len()))
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if err := e.encode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Pointer:
+		if v.IsNil() {
+			e.buffer = append(e.buffer, 0)
+			return nil
+		}
+		e.buffer = append(e.buffer, 1)
+		return e.encode(v.Elem())
+
+	case reflect.Interface:
+		if v.IsNil() {
+			e.buffer = binary.AppendUvarint(e.buffer, 0)
+			return nil
+		}
+		name := v.Elem().Type().String()
+		if _, ok := payloadTypes[name]; !ok {
+			return fmt.Errorf("binary: unregistered type %s", name)
+		}
+		e.buffer = binary.AppendUvarint(e.buffer, uint64(len(name)))
+		e.buffer = append(e.buffer, name...)
+		return e.encode(v.Elem())
+
+	default:
+		return fmt.Errorf("binary: cannot encode %s", v.Type())
+	}
+
+	return nil
+}
+
+func (e *binaryEncoder) encodeElements(v reflect.Value) error {
+	for i := range v.Len() {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	data []byte
+}
+
+func (d *binaryDecoder) byte() (byte, error) {
+	if len(d.data) == 0 {
+		return 0, errShortBuffer
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	n, size := binary.Varint(d.data)
+	if size <= 0 {
+		return 0, errShortBuffer
+	}
+	d.data = d.data[size:]
+	return n, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		return 0, errShortBuffer
+	}
+	d.data = d.data[size:]
+	return n, nil
+}
+
+// length reads a length prefix, which can never be more than the bytes left
+// since every element takes at least one.
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		return 0, errShortBuffer
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *binaryDecoder) decode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.byte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b != 0)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := d.varint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("binary: %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("binary: %d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		if len(d.data) < 8 {
+			return errShortBuffer
+		}
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(d.data)))
+		d.data = d.data[8:]
+
+	case reflect.String:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			v.SetZero()
+			return nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		return d.decodeElements(v)
+
+	case reflect.Array:
+		return d.decodeElements(v)
+
+	case reflect.Map:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		for range n {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Pointer:
+		present, err := d.byte()
+		if err != nil {
+			return err
+		}
+		if present == 0 {
+			v.SetZero()
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := d.decode(elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+
+	case reflect.Interface:
+		name, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if len(name) == 0 {
+			v.SetZero()
+			return nil
+		}
+		t, ok := payloadTypes[string(name)]
+		if !ok {
+			return fmt.Errorf("binary: unregistered type %s", name)
+		}
+		elem := reflect.New(t).Elem()
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		v.Set(elem)
+
+	default:
+		return fmt.Errorf("binary: cannot decode %s", v.Type())
+	}
+
+	return nil
+}
+
+func (d *binaryDecoder) decodeElements(v reflect.Value) error {
+	for i := range v.Len() {
+		if err := d.decode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
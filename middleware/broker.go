@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// DefaultPrefetch is how many unacked messages a consumer holds at most.
+const DefaultPrefetch = 50
+
+// Broker is the message broker under the Middleware. Exchanges are durable
+// topic exchanges and queues are durable, so both outlive the connections
+// that declared them. Publishing to the "" exchange sends the message to the
+// queue named by the key.
+type Broker interface {
+	DeclareExchange(name string) error
+	DeclareQueue(name string, options QueueOptions) error
+	BindQueue(queue string, key string, exchange string) error
+	Publish(exchange string, key string, message Message) error
+	// PublishAndWait publishes the message and waits until the broker took
+	// it into at least one queue, failing with ErrUnroutable if it matched
+	// none.
+	PublishAndWait(exchange string, key string, message Message) error
+	// PublishDeferred publishes the message like PublishAndWait without
+	// waiting. The channel receives the outcome PublishAndWait would
+	// return, except for the timeout, which is up to the caller.
+	PublishDeferred(exchange string, key string, message Message) (<-chan error, error)
+	// Consume delivers the messages of queue until ctx is done or the
+	// broker is closed. Once ctx is done the consumer is cancelled, the
+	// messages already delivered are still sent and can be acked, and then
+	// the channel is closed. Messages not acked when the broker is closed
+	// are requeued and redelivered to another consumer.
+	Consume(ctx context.Context, queue string) (<-chan Delivery, error)
+	Close() error
+}
+
+var (
+	ErrUnroutable     = errors.New("message routed to no queue")
+	ErrNacked         = errors.New("message rejected by the broker")
+	ErrConfirmTimeout = errors.New("timed out waiting for the broker to confirm the message")
+	ErrConfirmLost    = errors.New("connection lost before the broker confirmed the message")
+	ErrNoConfirms     = errors.New("publisher confirms are disabled")
+	ErrQueueArguments = errors.New("queue declared with other arguments, drain it and stop its consumers to recreate it")
+)
+
+// StateNotifier is implemented by the brokers whose connection can drop and
+// come back.
+type StateNotifier interface {
+	NotifyState(c chan<- ConnectionEvent)
+}
+
+type ConnectionState int
+
+const (
+	Connected ConnectionState = iota
+	Disconnected
+	Reconnecting
+	Closed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ConnectionEvent is a change of the broker connection state.
+type ConnectionEvent struct {
+	State ConnectionState
+	// Err is why the connection dropped, or why a reconnection attempt
+	// failed.
+	Err error
+	// Attempt is the number of the reconnection attempt, from 1.
+	Attempt int
+}
+
+type QueueOptions struct {
+	// ConsumerTimeout is how long a delivery may stay unacked before the
+	// broker closes the consumer. Zero leaves the broker default.
+	ConsumerTimeout time.Duration
+	// DeadLetterExchange is where the broker sends the messages rejected
+	// without requeue, with the queue name as routing key. Empty drops them.
+	DeadLetterExchange string
+}
+
+// Headers are the string headers of a message.
+type Headers map[string]string
+
+// Message is what is published to the broker.
+type Message struct {
+	Body []byte
+	// ContentType names the codec of the body.
+	ContentType string
+	// MessageId is the identity of the message, see Identity.
+	MessageId string
+	Headers   Headers
+}
+
+// Delivery is a message handed to a consumer. It must be acked or nacked
+// exactly once.
+type Delivery struct {
+	Message
+	// Redelivered is set when the message was delivered before and requeued.
+	Redelivered bool
+
+	ack  func() error
+	nack func(requeue bool) error
+}
+
+func (d Delivery) Ack() error {
+	return d.ack()
+}
+
+// Nack rejects the message, requeueing it if requeue is set and dropping it
+// otherwise.
+func (d Delivery) Nack(requeue bool) error {
+	return d.nack(requeue)
+}
+
+// matchTopic reports whether key matches the binding pattern of a topic
+// exchange. Both are lists of words separated by dots, in the pattern `*`
+// matches exactly one word and `#` zero or more.
+func matchTopic(pattern string, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern []string, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for skip := 0; skip <= len(key); skip++ {
+			if matchWords(pattern[1:], key[skip:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+	}
+}
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// Content types of the codecs, recorded on every message.
+const (
+	ContentTypeGob    = "application/x-gob"
+	ContentTypeJSON   = "application/json"
+	ContentTypeBinary = "application/x-compact-binary"
+)
+
+// legacyContentType is the content type of the messages published before
+// codecs, which are all gob.
+const legacyContentType = "text/plain"
+
+// Codec encodes the messages published and decodes the ones consumed.
+type Codec interface {
+	ContentType() string
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var (
+	GobCodec    Codec = gobCodec{}
+	JSONCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{}
+)
+
+var codecs = map[string]Codec{
+	"gob":    GobCodec,
+	"json":   JSONCodec,
+	"binary": BinaryCodec,
+}
+
+// CodecByName returns the codec named gob, json or binary.
+func CodecByName(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+// CodecFor returns the codec of contentType. Messages without one are gob.
+func CodecFor(contentType string) (Codec, error) {
+	switch contentType {
+	case "", legacyContentType:
+		return GobCodec, nil
+	}
+
+	for _, codec := range codecs {
+		if codec.ContentType() == contentType {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("no codec for content type %q", contentType)
+}
+
+// codecFromEnv returns the codec named by the CODEC env var, gob by default.
+func codecFromEnv() (Codec, error) {
+	name := os.Getenv("CODEC")
+	if name == "" {
+		return GobCodec, nil
+	}
+	return CodecByName(name)
+}
+
+// SetCodec replaces the codec the messages are published with. Consumers
+// decode any codec, so producers can switch one at a time.
+func (m *Middleware) SetCodec(codec Codec) {
+	m.codec = codec
+}
+
+// payloadTypes are the types a Result payload can hold, by name. Gob and the
+// binary codec record the name with the value, and JSON next to it.
+var payloadTypes = make(map[string]reflect.Type)
+
+func init() {
+	RegisterPayload(Query1Result{})
+	RegisterPayload(Query2Result{})
+	RegisterPayload(Query3Result{})
+	RegisterPayload(Query4Result{})
+	RegisterPayload(Query5Result{})
+}
+
+// RegisterPayload registers the type of value for the Result payloads. It
+// must be called by every process before publishing or consuming them.
+func RegisterPayload(value interface{}) {
+	gob.Register(value)
+
+	t := reflect.TypeOf(value)
+	payloadTypes[t.String()] = t
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return ContentTypeGob
+}
+
+func (gobCodec) Encode(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// resultJSON is a Result with the type of its payload, which JSON would lose.
+type resultJSON struct {
+	ClientId       string
+	QueryId        int
+	IsFinalMessage bool
+	PayloadType    string          `json:",omitempty"`
+	Payload        json.RawMessage `json:",omitempty"`
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	encoded := resultJSON{ClientId: r.ClientId, QueryId: r.QueryId, IsFinalMessage: r.IsFinalMessage}
+	if r.Payload != nil {
+		payload, err := json.Marshal(r.Payload)
+		if err != nil {
+			return nil, err
+		}
+		encoded.PayloadType = reflect.TypeOf(r.Payload).String()
+		encoded.Payload = payload
+	}
+
+	return json.Marshal(encoded)
+}
+
+func (r *Result) UnmarshalJSON(data []byte) error {
+	var decoded resultJSON
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	r.ClientId = decoded.ClientId
+	r.QueryId = decoded.QueryId
+	r.IsFinalMessage = decoded.IsFinalMessage
+	r.Payload = nil
+	if decoded.PayloadType == "" {
+		return nil
+	}
+
+	t, ok := payloadTypes[decoded.PayloadType]
+	if !ok {
+		return fmt.Errorf("unregistered payload type %q", decoded.PayloadType)
+	}
+
+	payload := reflect.New(t)
+	err = json.Unmarshal(decoded.Payload, payload.Interface())
+	if err != nil {
+		return err
+	}
+	r.Payload = payload.Elem().Interface()
+
+	return nil
+}
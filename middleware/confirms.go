@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// confirmTimeout is how long PublishAndWait waits for the broker to confirm
+// a message.
+const confirmTimeout = 5 * time.Second
+
+// seqHeader carries the publish sequence number of a message, so a returned
+// message can be matched with its confirmation.
+const seqHeader = "x-publish-seq"
+
+// session is a connection and the channel everything is done on.
+type session struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	// confirms is nil unless the channel is in confirm mode.
+	confirms *confirmer
+
+	publishMutex sync.Mutex
+}
+
+// publish sends a message. With confirms it is tracked under the sequence
+// number the channel gives it, and done, if not nil, receives the outcome.
+func (s *session) publish(exchange string, key string, message Message, mandatory bool, done chan error) error {
+	publishing := amqp.Publishing{
+		ContentType: message.ContentType,
+		MessageId:   message.MessageId,
+		Headers:     toTable(message.Headers),
+		Body:        message.Body,
+	}
+
+	if s.confirms == nil {
+		return s.channel.Publish(exchange, key, mandatory, false, publishing)
+	}
+
+	// the sequence number is only ours until the publish is sent
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+
+	seq := s.channel.GetNextPublishSeqNo()
+	publishing.Headers[seqHeader] = int64(seq)
+	s.confirms.track(seq, &pendingPublish{exchange: exchange, key: key, done: done})
+
+	err := s.channel.Publish(exchange, key, mandatory, false, publishing)
+	if err != nil {
+		s.confirms.untrack(seq)
+	}
+	return err
+}
+
+type pendingPublish struct {
+	exchange string
+	key      string
+	returned bool
+	done     chan error
+}
+
+// confirmer tracks the messages published on a channel in confirm mode until
+// the broker confirms them.
+type confirmer struct {
+	mutex   sync.Mutex
+	pending map[uint64]*pendingPublish
+}
+
+func newConfirmer(channel *amqp.Channel) *confirmer {
+	c := &confirmer{pending: make(map[uint64]*pendingPublish)}
+
+	// Both are unbuffered and read by a single goroutine, so a return, which
+	// the broker sends before the confirmation of its message, is always
+	// handled first.
+	confirmations := channel.NotifyPublish(make(chan amqp.Confirmation))
+	returns := channel.NotifyReturn(make(chan amqp.Return))
+	go c.listen(confirmations, returns)
+
+	return c
+}
+
+func (c *confirmer) track(seq uint64, publish *pendingPublish) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pending[seq] = publish
+}
+
+func (c *confirmer) untrack(seq uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, seq)
+}
+
+func (c *confirmer) listen(confirmations <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.returned(ret)
+
+		case confirmation, ok := <-confirmations:
+			if !ok {
+				c.fail()
+				return
+			}
+			c.confirm(confirmation)
+		}
+	}
+}
+
+func (c *confirmer) returned(ret amqp.Return) {
+	seq, ok := ret.Headers[seqHeader].(int64)
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if publish, ok := c.pending[uint64(seq)]; ok {
+		publish.returned = true
+	}
+}
+
+func (c *confirmer) confirm(confirmation amqp.Confirmation) {
+	c.mutex.Lock()
+	publish, ok := c.pending[confirmation.DeliveryTag]
+	delete(c.pending, confirmation.DeliveryTag)
+	c.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	var err error
+	if !confirmation.Ack {
+		err = ErrNacked
+	} else if publish.returned {
+		err = ErrUnroutable
+	}
+
+	publish.finish(err)
+}
+
+// fail ends every publish still waiting, the channel closed before the
+// broker confirmed them.
+func (c *confirmer) fail() {
+	c.mutex.Lock()
+	pending := c.pending
+	c.pending = make(map[uint64]*pendingPublish)
+	c.mutex.Unlock()
+
+	for _, publish := range pending {
+		publish.finish(ErrConfirmLost)
+	}
+}
+
+func (p *pendingPublish) finish(err error) {
+	if p.done != nil {
+		p.done <- err
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to publish message to %q with key %q: %v", p.exchange, p.key, err)
+	}
+}
+
+func toTable(headers Headers) amqp.Table {
+	table := amqp.Table{}
+	for name, value := range headers {
+		table[name] = value
+	}
+	return table
+}
+
+// fromTable returns the headers of a delivery, formatting the values that
+// are not strings. The publish sequence number is dropped, it only means
+// something to the publishing channel.
+func fromTable(table amqp.Table) Headers {
+	headers := Headers{}
+	for name, value := range table {
+		if name == seqHeader {
+			continue
+		}
+		if text, ok := value.(string); ok {
+			headers[name] = text
+		} else {
+			headers[name] = fmt.Sprint(value)
+		}
+	}
+	return headers
+}
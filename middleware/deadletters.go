@@ -0,0 +1,372 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Every queue sends its dead letters to this exchange, with the queue name as
+// routing key, and they all end up in the dead letters queue.
+const (
+	DeadLettersExchange = "dead-letters"
+	deadLettersQueue    = "dead-letters"
+)
+
+// DefaultMaxAttempts is how many times a message is handed to a callback
+// that fails before it is dead-lettered.
+const DefaultMaxAttempts = 5
+
+// Headers set on the messages that are retried or dead-lettered.
+const (
+	HeaderAttempts      = "x-attempts"
+	HeaderFailureReason = "x-failure-reason"
+	HeaderOriginalQueue = "x-original-queue"
+	HeaderFailedAt      = "x-failed-at"
+	// HeaderRetry is `<producer>@<run>:<n>`, the nth retry the producer
+	// sent to the queue since it started.
+	HeaderRetry = "x-retry"
+	// HeaderEOFDeferred is `<producer>@<run>:<n>` on an end of stream the
+	// producer sent back to the queue behind its retries up to the nth.
+	HeaderEOFDeferred = "x-eof-deferred"
+)
+
+// DeadLetter is a message that failed to decode, or whose callback failed
+// too many times.
+type DeadLetter struct {
+	// Queue is the queue the message was consumed from.
+	Queue       string
+	Reason      string
+	Attempts    int
+	FailedAt    time.Time
+	Body        []byte
+	ContentType string
+	MessageId   string
+	Headers     Headers
+
+	msg Delivery
+}
+
+// SetMaxAttempts sets how many times a message is handed to a callback that
+// fails before it is dead-lettered. It must be set before consuming.
+func (m *Middleware) SetMaxAttempts(attempts int) {
+	m.maxAttempts = attempts
+}
+
+func (m *Middleware) declareDeadLetters() error {
+	err := m.broker.DeclareExchange(DeadLettersExchange)
+	if err != nil {
+		return &TopologyError{Kind: "exchange", Name: DeadLettersExchange, Err: err}
+	}
+
+	err = m.broker.DeclareQueue(deadLettersQueue, QueueOptions{})
+	if err != nil {
+		return &TopologyError{Kind: "queue", Name: deadLettersQueue, Err: err}
+	}
+
+	err = m.broker.BindQueue(deadLettersQueue, "#", DeadLettersExchange)
+	if err != nil {
+		return &TopologyError{Kind: "binding", Name: DeadLettersExchange + " #", Err: err}
+	}
+
+	return nil
+}
+
+// retries are the retries a consumer sent to the tail of a queue and has not
+// seen delivered yet.
+type retries struct {
+	last    uint64
+	pending map[uint64]bool
+}
+
+// handle runs callback for msg. When the callback fails without acking, the
+// message is sent back to the end of queue, and dead-lettered once it failed
+// maxAttempts times. A callback that fails must not ack the message later.
+func (m *Middleware) handle(queue string, msg Delivery, callback func(ack func()) error) {
+	m.retryDelivered(queue, msg)
+
+	var acked atomic.Bool
+	ack := m.acker(msg)
+
+	err := callback(func() {
+		acked.Store(true)
+		ack()
+	})
+	if err == nil {
+		return
+	}
+
+	m.report(err)
+	if !acked.Load() {
+		m.retry(queue, msg, err)
+	}
+}
+
+func (m *Middleware) retry(queue string, msg Delivery, cause error) {
+	attempts := attempts(msg.Headers) + 1
+	if attempts >= m.maxAttempts {
+		m.deadLetter(queue, msg, attempts, cause.Error())
+		return
+	}
+
+	headers := Headers{}
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+	headers[HeaderAttempts] = strconv.Itoa(attempts)
+
+	n := m.retrySent(queue)
+	headers[HeaderRetry] = m.mark(n)
+
+	message := msg.Message
+	message.Headers = headers
+
+	err := m.forward("", queue, message)
+	if err != nil {
+		m.retryDone(queue, n)
+		m.report(&PublishError{Exchange: "", Key: queue, Err: err})
+		if err := msg.Nack(true); err != nil {
+			m.report(err)
+		}
+		return
+	}
+
+	m.acker(msg)()
+}
+
+// retrySent records a retry about to be sent to queue and returns its number.
+func (m *Middleware) retrySent(queue string) uint64 {
+	m.retryMutex.Lock()
+	defer m.retryMutex.Unlock()
+
+	r, ok := m.retries[queue]
+	if !ok {
+		r = &retries{pending: make(map[uint64]bool)}
+		m.retries[queue] = r
+	}
+
+	r.last++
+	r.pending[r.last] = true
+	return r.last
+}
+
+// retryDone forgets the retry n of queue.
+func (m *Middleware) retryDone(queue string, n uint64) {
+	m.retryMutex.Lock()
+	defer m.retryMutex.Unlock()
+
+	if r, ok := m.retries[queue]; ok {
+		delete(r.pending, n)
+	}
+}
+
+// retryDelivered forgets msg if it is a retry of the process.
+func (m *Middleware) retryDelivered(queue string, msg Delivery) {
+	if n, ok := m.ownMark(msg.Headers[HeaderRetry]); ok {
+		m.retryDone(queue, n)
+	}
+}
+
+// mark is the value of the retry headers for the nth retry of the process.
+func (m *Middleware) mark(n uint64) string {
+	return fmt.Sprintf("%s@%d:%d", m.producerID, m.retryRun, n)
+}
+
+// ownMark parses a retry header value sent by the process.
+func (m *Middleware) ownMark(value string) (uint64, bool) {
+	separator := strings.LastIndexByte(value, ':')
+	if separator < 0 || value[:separator] != fmt.Sprintf("%s@%d", m.producerID, m.retryRun) {
+		return 0, false
+	}
+	number := value[separator+1:]
+
+	n, err := strconv.ParseUint(number, 10, 64)
+	return n, err == nil
+}
+
+// deferEOF sends an end of stream back to the tail of queue, and acks it, if
+// retries the process sent to queue before are still to be delivered. The end
+// of stream then arrives after them, so a message that failed right before it
+// is not taken for a late one. Once the deferred end of stream comes back,
+// every retry sent before it was delivered, to this consumer or to another one
+// of a shared queue. The retries sent before a restart are not tracked.
+func (m *Middleware) deferEOF(queue string, msg Delivery) (bool, error) {
+	m.retryMutex.Lock()
+	r, ok := m.retries[queue]
+	if ok {
+		if n, own := m.ownMark(msg.Headers[HeaderEOFDeferred]); own {
+			for pending := range r.pending {
+				if pending <= n {
+					delete(r.pending, pending)
+				}
+			}
+		}
+	}
+	if !ok || len(r.pending) == 0 {
+		m.retryMutex.Unlock()
+		return false, nil
+	}
+	pending, last := len(r.pending), r.last
+	m.retryMutex.Unlock()
+
+	headers := Headers{}
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+	headers[HeaderEOFDeferred] = m.mark(last)
+
+	err := m.forward("", queue, Message{Headers: headers})
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Deferring end of stream of client %q on %s behind %d retries", msg.Headers[HeaderClientID], queue, pending)
+	m.acker(msg)()
+	return true, nil
+}
+
+// deadLetter sends msg to the dead letters exchange with the reason it
+// failed. If that fails the message is rejected, which has the broker
+// dead-letter it without the reason.
+func (m *Middleware) deadLetter(queue string, msg Delivery, attempts int, reason string) {
+	headers := Headers{}
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+	headers[HeaderAttempts] = strconv.Itoa(attempts)
+	headers[HeaderFailureReason] = reason
+	headers[HeaderOriginalQueue] = queue
+	headers[HeaderFailedAt] = time.Now().UTC().Format(time.RFC3339)
+
+	message := msg.Message
+	message.Headers = headers
+
+	err := m.forward(DeadLettersExchange, queue, message)
+	if err != nil {
+		m.report(&PublishError{Exchange: DeadLettersExchange, Key: queue, Err: err})
+		if err := msg.Nack(false); err != nil {
+			m.report(err)
+		}
+		return
+	}
+
+	m.acker(msg)()
+}
+
+// forward publishes a message that is acked once published, waiting for the
+// broker to take it when it has confirms.
+func (m *Middleware) forward(exchange string, key string, message Message) error {
+	err := m.broker.PublishAndWait(exchange, key, message)
+	if errors.Is(err, ErrNoConfirms) {
+		return m.broker.Publish(exchange, key, message)
+	}
+	return err
+}
+
+func attempts(headers Headers) int {
+	attempts, err := strconv.Atoi(headers[HeaderAttempts])
+	if err != nil {
+		return 0
+	}
+	return attempts
+}
+
+type DeadLettersQueue struct {
+	middleware *Middleware
+}
+
+func (m *Middleware) ListenDeadLetters() (*DeadLettersQueue, error) {
+	return &DeadLettersQueue{middleware: m}, nil
+}
+
+// Consume hands every dead letter to callback, which must ack or nack it,
+// until ctx is done or callback fails. Dead letters left unsettled are
+// requeued when the Middleware is closed.
+func (dq *DeadLettersQueue) Consume(ctx context.Context, callback func(letter *DeadLetter) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	msgs, err := dq.middleware.consumeQueue(ctx, deadLettersQueue)
+	if err != nil {
+		return err
+	}
+
+	for msg := range msgs {
+		if err := callback(newDeadLetter(msg)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newDeadLetter(msg Delivery) *DeadLetter {
+	letter := &DeadLetter{
+		Queue:       msg.Headers[HeaderOriginalQueue],
+		Reason:      msg.Headers[HeaderFailureReason],
+		Attempts:    attempts(msg.Headers),
+		Body:        msg.Body,
+		ContentType: msg.ContentType,
+		MessageId:   msg.MessageId,
+		Headers:     msg.Headers,
+		msg:         msg,
+	}
+	letter.FailedAt, _ = time.Parse(time.RFC3339, msg.Headers[HeaderFailedAt])
+
+	// dead-lettered by the broker itself, on a reject without requeue
+	if letter.Queue == "" {
+		letter.Queue = msg.Headers["x-first-death-queue"]
+		letter.Reason = msg.Headers["x-first-death-reason"]
+	}
+
+	return letter
+}
+
+func (l *DeadLetter) Ack() error {
+	return l.msg.Ack()
+}
+
+// Nack puts the dead letter back in the dead letters queue.
+func (l *DeadLetter) Nack() error {
+	return l.msg.Nack(true)
+}
+
+// Republish sends the dead letter back to the queue it came from, with its
+// attempts reset, and acks it.
+func (m *Middleware) Republish(letter *DeadLetter) error {
+	if letter.Queue == "" {
+		return fmt.Errorf("dead letter has no original queue")
+	}
+
+	headers := Headers{}
+	for name, value := range letter.Headers {
+		if isFailureHeader(name) {
+			continue
+		}
+		headers[name] = value
+	}
+
+	message := Message{Body: letter.Body, ContentType: letter.ContentType, MessageId: letter.MessageId, Headers: headers}
+	err := m.forward("", letter.Queue, message)
+	if err != nil {
+		return &PublishError{Exchange: "", Key: letter.Queue, Err: err}
+	}
+
+	return letter.Ack()
+}
+
+// isFailureHeader reports whether name is one of the headers that record the
+// failures of a message, ours or the ones the broker adds when it
+// dead-letters a message itself.
+func isFailureHeader(name string) bool {
+	switch name {
+	case HeaderAttempts, HeaderFailureReason, HeaderOriginalQueue, HeaderFailedAt, HeaderRetry, "x-death":
+		return true
+	}
+	return strings.HasPrefix(name, "x-first-death-") || strings.HasPrefix(name, "x-last-death-")
+}
@@ -0,0 +1,385 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+// Headers of the end of stream messages, which have no body.
+const (
+	// HeaderEOFProducer is the id of the producer that finished.
+	HeaderEOFProducer = "x-eof-producer"
+	// HeaderEOFSeen lists, comma separated, the consumers of a shared queue
+	// that already got the end of stream.
+	HeaderEOFSeen = "x-eof-seen"
+	// HeaderClientID is the client whose stream ended.
+	HeaderClientID = "x-client-id"
+)
+
+// eofWord ends the routing key of the end of stream messages on the topic
+// exchanges whose keys carry more than the shard.
+const eofWord = "_eof"
+
+// EOFState is what a consumer knows about the end of stream of a queue.
+type EOFState struct {
+	// Finished are the producers whose end of stream was seen.
+	Finished []string
+	// Propagated is set once the end of the whole stream was passed on.
+	Propagated bool
+}
+
+// EOFStore keeps the EOFState of the queues of a consumer, one per client, so
+// that a restart neither waits for an end of stream that was already acked
+// nor passes it on twice. Of a stream that ended only that it ended is kept,
+// for the late duplicates of its end of stream to be dropped.
+type EOFStore interface {
+	Load(queue string) (EOFState, error)
+	Save(queue string, state EOFState) error
+}
+
+// SetEOFStore replaces the store of the end of stream states, which by
+// default lives in memory and is lost on restart. It must be set before
+// consuming.
+func (m *Middleware) SetEOFStore(store EOFStore) {
+	m.eofStore = store
+}
+
+// SetProducerID sets the id the end of stream messages of the process are
+// tagged with, and the id it consumes shared queues as. It must be stable
+// across restarts and unique in the system.
+func (m *Middleware) SetProducerID(id string) {
+	m.producerID = id
+}
+
+// The streams whose end is tracked, to set how many producers feed each.
+const (
+	StreamGames   = "games"
+	StreamReviews = "reviews"
+	StreamStats   = "stats"
+	StreamResults = "results"
+)
+
+// SetProducers sets how many producers send an end of stream to each queue
+// of stream. By default the games and reviews come from a single client,
+// and the stats and results from one mapper or worker per shard.
+func (m *Middleware) SetProducers(stream string, producers int) {
+	m.producers[stream] = producers
+}
+
+func (m *Middleware) expectedProducers(stream string) int {
+	if producers, ok := m.producers[stream]; ok {
+		return producers
+	}
+
+	switch stream {
+	case StreamStats, StreamResults:
+		return m.partitioner.Shards()
+	}
+	return 1
+}
+
+// producersFromEnv reads the producers of every stream from the
+// GAMES_PRODUCERS, REVIEWS_PRODUCERS, STATS_PRODUCERS and RESULTS_PRODUCERS
+// env vars.
+func producersFromEnv() (map[string]int, error) {
+	producers := make(map[string]int)
+	for _, stream := range []string{StreamGames, StreamReviews, StreamStats, StreamResults} {
+		name := strings.ToUpper(stream) + "_PRODUCERS"
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid %s %q", name, value)
+		}
+		producers[stream] = n
+	}
+
+	return producers, nil
+}
+
+// producerIDFromEnv returns the PRODUCER_ID env var, or the host name.
+func producerIDFromEnv() (string, error) {
+	if id := os.Getenv("PRODUCER_ID"); id != "" {
+		return id, nil
+	}
+	return os.Hostname()
+}
+
+// defaultProducerID is unique to the process, but changes on restart.
+func defaultProducerID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+type memoryEOFStore struct {
+	mutex  sync.Mutex
+	states map[string]EOFState
+}
+
+func newMemoryEOFStore() *memoryEOFStore {
+	return &memoryEOFStore{states: make(map[string]EOFState)}
+}
+
+func (s *memoryEOFStore) Load(queue string) (EOFState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.states[queue]
+	state.Finished = slices.Clone(state.Finished)
+	return state, nil
+}
+
+func (s *memoryEOFStore) Save(queue string, state EOFState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if state.Propagated {
+		state = EOFState{Propagated: true}
+	}
+	state.Finished = slices.Clone(state.Finished)
+	s.states[queue] = state
+	return nil
+}
+
+// endedFile lists the streams that ended, whose state files are removed.
+const endedFile = "ended.log"
+
+// FileEOFStore keeps the EOFState of every stream that has not ended in a
+// JSON file of dir, replaced atomically and synced on every save. A stream
+// that ended only leaves a line in the ended log.
+type FileEOFStore struct {
+	dir   string
+	files *durability.Files
+	ended *durability.Set
+}
+
+func NewFileEOFStore(dir string) (*FileEOFStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	ended, err := durability.OpenSet(filepath.Join(dir, endedFile))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileEOFStore{dir: dir, files: durability.NewFiles(durability.Commit), ended: ended}
+
+	// the state files of the streams that ended right before a crash
+	for _, queue := range ended.Entries() {
+		err := s.files.Remove(s.path(queue))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, s.files.Sync()
+}
+
+func (s *FileEOFStore) path(queue string) string {
+	return filepath.Join(s.dir, url.PathEscape(queue)+".json")
+}
+
+func (s *FileEOFStore) Load(queue string) (EOFState, error) {
+	var state EOFState
+	if s.ended.Contains(queue) {
+		state.Propagated = true
+		return state, nil
+	}
+
+	data, err := os.ReadFile(s.path(queue))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (s *FileEOFStore) Save(queue string, state EOFState) error {
+	if state.Propagated {
+		err := s.ended.Add(queue)
+		if err != nil {
+			return err
+		}
+
+		err = s.files.Remove(s.path(queue))
+		if err != nil {
+			return err
+		}
+		return s.files.Sync()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = s.files.WriteAtomic(s.path(queue), func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.files.Sync()
+}
+
+// endOfStream tracks the end of stream of every client on a queue fed by
+// producers producers and shared by consumers consumers, each of which must
+// see the end of stream of every producer.
+type endOfStream struct {
+	queue     string
+	producers int
+	consumers int
+	// states are the states of the clients whose stream has not ended yet.
+	states map[string]*EOFState
+}
+
+func newEndOfStream(queue string, end *EndOfStream) *endOfStream {
+	return &endOfStream{
+		queue:     queue,
+		producers: end.Producers,
+		consumers: max(end.Consumers, 1),
+		states:    make(map[string]*EOFState),
+	}
+}
+
+// key is what the state of a client is stored under. The messages without a
+// client keep the key of the queue.
+func (e *endOfStream) key(clientId string) string {
+	if clientId == "" {
+		return e.queue
+	}
+	return e.queue + "/" + clientId
+}
+
+// state returns the state of a client, loading it from store the first time.
+func (e *endOfStream) state(store EOFStore, clientId string) (*EOFState, error) {
+	if state, ok := e.states[clientId]; ok {
+		return state, nil
+	}
+
+	state, err := store.Load(e.key(clientId))
+	if err != nil {
+		return nil, err
+	}
+	if !state.Propagated {
+		e.states[clientId] = &state
+	}
+	return &state, nil
+}
+
+// propagated records that the stream of a client ended and was passed on.
+func (e *endOfStream) propagated(store EOFStore, clientId string, state *EOFState) error {
+	state.Propagated = true
+	err := store.Save(e.key(clientId), *state)
+	if err != nil {
+		return err
+	}
+
+	delete(e.states, clientId)
+	return nil
+}
+
+// sendEOF sends the end of stream of the process for a client to key.
+func (m *Middleware) sendEOF(exchange string, key string, clientId string) error {
+	headers := Headers{HeaderEOFProducer: m.producerID}
+	if clientId != "" {
+		headers[HeaderClientID] = clientId
+	}
+	return m.publishMessageAndWait(exchange, key, Message{Headers: headers})
+}
+
+// broadcastEOF sends the end of stream of the process for a client to every
+// shard, the routing key of each given by key. Shards without a queue are
+// skipped.
+func (m *Middleware) broadcastEOF(exchange string, clientId string, key func(shardId string) string) error {
+	for shardId := range m.partitioner.Shards() {
+		stringShardId := fmt.Sprint(shardId)
+		err := m.sendEOF(exchange, key(stringShardId), clientId)
+		if errors.Is(err, ErrUnroutable) {
+			log.Printf("No queue bound for %s shard %s, skipping its end of stream", exchange, stringShardId)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isEOF reports whether msg is an end of stream.
+func isEOF(msg Delivery) bool {
+	_, ok := msg.Headers[HeaderEOFProducer]
+	return ok
+}
+
+// handleEOF records the end of stream in msg and passes it on to the other
+// consumers of a shared queue. It returns the client of msg and whether its
+// stream just ended, and leaves msg to be acked by the caller.
+//
+// Every step can be repeated: a producer already recorded is not recorded
+// again, a copy relayed twice is dropped once every consumer saw it, and a
+// duplicate of a stream that already ended is only relayed.
+func (m *Middleware) handleEOF(eof *endOfStream, msg Delivery) (string, bool, error) {
+	producer := msg.Headers[HeaderEOFProducer]
+	clientId := msg.Headers[HeaderClientID]
+
+	state, err := eof.state(m.eofStore, clientId)
+	if err != nil {
+		return clientId, false, err
+	}
+
+	if !state.Propagated && !slices.Contains(state.Finished, producer) {
+		state.Finished = append(state.Finished, producer)
+		err := m.eofStore.Save(eof.key(clientId), *state)
+		if err != nil {
+			return clientId, false, err
+		}
+		log.Printf("Producer %s finished client %q on %s, %d of %d", producer, clientId, eof.queue, len(state.Finished), eof.producers)
+	}
+
+	var seen []string
+	if value := msg.Headers[HeaderEOFSeen]; value != "" {
+		seen = strings.Split(value, ",")
+	}
+	if !slices.Contains(seen, m.producerID) {
+		seen = append(seen, m.producerID)
+	}
+
+	// the others of a shared queue still need it
+	if len(seen) < eof.consumers {
+		headers := Headers{HeaderEOFProducer: producer, HeaderEOFSeen: strings.Join(seen, ",")}
+		if clientId != "" {
+			headers[HeaderClientID] = clientId
+		}
+		err := m.forward("", eof.queue, Message{Headers: headers})
+		if err != nil {
+			return clientId, false, err
+		}
+	}
+
+	return clientId, !state.Propagated && len(state.Finished) >= eof.producers, nil
+}
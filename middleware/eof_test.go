@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func connect(t *testing.T, memory *Memory, producerID string, shards int) *Middleware {
+	t.Helper()
+
+	m, err := NewMiddlewareWithBroker(memory.Connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	m.SetPartitioner(Modulo(shards))
+	m.SetProducerID(producerID)
+	return m
+}
+
+// Every mapper sharing the reviews queue ends the stream of each client
+// exactly once, even when the end of stream is sent twice.
+func TestSharedQueueEndsOncePerConsumer(t *testing.T) {
+	memory := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	ends := make(map[string][]string)
+	for _, mapper := range []string{"mapper-0", "mapper-1"} {
+		m := connect(t, memory, mapper, 2)
+		queue, err := m.ListenReviews()
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue.OnEnd(func(clientId string) error {
+			mutex.Lock()
+			ends[mapper] = append(ends[mapper], clientId)
+			mutex.Unlock()
+			return nil
+		})
+		go queue.Consume(ctx, func(batch *ReviewsBatch, ack func()) error {
+			ack()
+			return nil
+		})
+	}
+
+	client := connect(t, memory, "client", 2)
+	for _, clientId := range []string{"a", "b", "a"} {
+		if err := client.SendReviewsFinished(clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, mapper := range []string{"mapper-0", "mapper-1"} {
+		if len(ends[mapper]) != 2 || ends[mapper][0] == ends[mapper][1] {
+			t.Errorf("%s ended %v, want a and b once each", mapper, ends[mapper])
+		}
+	}
+}
+
+// The stream of a client ends once every producer finished it, and a
+// restart with the same store does not end it again.
+func TestEndOfStreamWaitsForEveryProducer(t *testing.T) {
+	memory := NewMemory()
+	store := newMemoryEOFStore()
+
+	ended := make(chan string, 4)
+	listen := func(ctx context.Context) {
+		m := connect(t, memory, "worker", 1)
+		m.SetProducers(StreamStats, 2)
+		m.SetEOFStore(store)
+		queue, err := m.ListenStats("0", "Action")
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue.OnEnd(func(clientId string) error {
+			ended <- clientId
+			return nil
+		})
+		go queue.Consume(ctx, func(message *StatsMsg, ack func()) error {
+			ack()
+			return nil
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listen(ctx)
+
+	first := connect(t, memory, "mapper-0", 1)
+	second := connect(t, memory, "mapper-1", 1)
+
+	if err := first.SendStatsFinished("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case clientId := <-ended:
+		t.Fatalf("client %s ended after one of two producers", clientId)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := second.SendStatsFinished("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case clientId := <-ended:
+		if clientId != "a" {
+			t.Fatalf("ended client %s, want a", clientId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client a did not end")
+	}
+
+	cancel()
+	restarted, cancelRestarted := context.WithCancel(context.Background())
+	defer cancelRestarted()
+	listen(restarted)
+
+	if err := first.SendStatsFinished("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case clientId := <-ended:
+		t.Fatalf("client %s ended again after a restart", clientId)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// A message that fails right before the end of stream of its client is
+// retried before the stream ends, not after.
+func TestEndOfStreamWaitsForRetries(t *testing.T) {
+	memory := NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	worker := connect(t, memory, "worker", 1)
+	worker.SetProducers(StreamStats, 1)
+	queue, err := worker.ListenStats("0", "Action")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan string, 4)
+	queue.OnEnd(func(clientId string) error {
+		events <- "end " + clientId
+		return nil
+	})
+
+	failed := false
+	go queue.Consume(ctx, func(message *StatsMsg, ack func()) error {
+		if !failed {
+			failed = true
+			events <- "failed"
+			return errors.New("failed once")
+		}
+		events <- "processed"
+		ack()
+		return nil
+	})
+
+	mapper := connect(t, memory, "mapper-0", 1)
+	err = mapper.SendStats(&StatsMsg{ClientId: "a", Stats: &Stats{AppId: 1, Genres: []string{"Action"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mapper.SendStatsFinished("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"failed", "processed", "end a"} {
+		select {
+		case event := <-events:
+			if event != want {
+				t.Fatalf("got %s, want %s", event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s", want)
+		}
+	}
+}
+
+// A Consume that returns on an error cancels its consumer, so the messages
+// left go to the next one.
+func TestConsumeCancelsOnError(t *testing.T) {
+	memory := NewMemory()
+	m := connect(t, memory, "worker", 1)
+	m.SetProducers(StreamStats, 1)
+	queue, err := m.ListenStats("0", "Action")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("commit failed")
+	queue.OnEnd(func(string) error { return failed })
+
+	if err := connect(t, memory, "mapper", 1).SendStatsFinished("a"); err != nil {
+		t.Fatal(err)
+	}
+	err = queue.Consume(context.Background(), func(*StatsMsg, func()) error { return nil })
+	if !errors.Is(err, failed) {
+		t.Fatalf("Consume = %v, want the OnEnd error", err)
+	}
+
+	// the consumer is cancelled asynchronously once ctx is done
+	deadline := time.Now().Add(time.Second)
+	for {
+		memory.mutex.Lock()
+		consumers := len(memory.queues[queue.name].consumers)
+		memory.mutex.Unlock()
+		if consumers == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d consumers left after Consume returned", consumers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+)
+
+// DecodeError is a message of queue whose body could not be decoded. The
+// message is dead-lettered, since it would fail again on every redelivery.
+type DecodeError struct {
+	Queue string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode message from %s: %v", e.Queue, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// PublishError is a message that could not be encoded or published.
+type PublishError struct {
+	Exchange string
+	Key      string
+	Err      error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("failed to publish message to %q with key %q: %v", e.Exchange, e.Key, e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// TopologyError is a failure to declare an exchange, a queue, a binding or a
+// consumer.
+type TopologyError struct {
+	// Kind is what was declared: exchange, queue, binding or consumer.
+	Kind string
+	Name string
+	Err  error
+}
+
+func (e *TopologyError) Error() string {
+	return fmt.Sprintf("failed to declare %s %s: %v", e.Kind, e.Name, e.Err)
+}
+
+func (e *TopologyError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandler receives the errors of the Consume loops that are not
+// returned to anyone: messages that do not decode, failed acks, retries and
+// dead letters, and the errors returned by the callbacks.
+type ErrorHandler func(err error)
+
+func logError(err error) {
+	log.Printf("middleware: %v", err)
+}
+
+// SetErrorHandler replaces the handler of the Consume loop errors, which by
+// default logs them. It must be set before consuming.
+func (m *Middleware) SetErrorHandler(handler ErrorHandler) {
+	m.errorHandler = handler
+}
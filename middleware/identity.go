@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"maps"
+	"strconv"
+)
+
+// Headers of the identity the middleware stamps on every message with a body
+// it publishes, along with HeaderClientID for the messages of a client. End
+// of stream messages have none.
+const (
+	// HeaderProducer is the producer id of the publishing process.
+	HeaderProducer = "x-producer"
+	// HeaderStream is the exchange and routing key the message was published
+	// to, as `<exchange>/<key>`.
+	HeaderStream = "x-stream"
+	// HeaderSequence is the number of the message in the stream of its
+	// client.
+	HeaderSequence = "x-sequence"
+)
+
+// Identity is what a message can be deduplicated by. Every producer numbers
+// the messages of each client it publishes to each stream from 1 up, so a
+// queue bound to the key of a stream, and a database kept per client behind
+// it, gets the numbers of each client without gaps, and a producer that
+// replays its input after a restart numbers every message as before.
+type Identity struct {
+	Producer string
+	Stream   string
+	ClientId string
+	Sequence int64
+}
+
+// Source is who numbered the message, its producer and stream.
+func (id Identity) Source() string {
+	return id.Producer + "/" + id.Stream
+}
+
+// MessageId is the AMQP message id of the message.
+func (id Identity) MessageId() string {
+	if id.ClientId == "" {
+		return id.Source() + "/" + strconv.FormatInt(id.Sequence, 10)
+	}
+	return id.Source() + "/" + id.ClientId + "/" + strconv.FormatInt(id.Sequence, 10)
+}
+
+// Identity returns the identity stamped on the message, or false if it was
+// published without one.
+func (m Message) Identity() (Identity, bool) {
+	producer, ok := m.Headers[HeaderProducer]
+	if !ok {
+		return Identity{}, false
+	}
+
+	sequence, err := strconv.ParseInt(m.Headers[HeaderSequence], 10, 64)
+	if err != nil || sequence < 1 {
+		return Identity{}, false
+	}
+
+	return Identity{Producer: producer, Stream: m.Headers[HeaderStream], ClientId: m.Headers[HeaderClientID], Sequence: sequence}, true
+}
+
+// clientMessage is a message of the dataset of a client.
+type clientMessage interface {
+	clientID() string
+}
+
+func (m *GameMsg) clientID() string      { return m.ClientId }
+func (m *ReviewsBatch) clientID() string { return m.ClientId }
+func (m *StatsMsg) clientID() string     { return m.ClientId }
+func (m *Result) clientID() string       { return m.ClientId }
+
+// clientOf returns the client of body, "" if it belongs to none.
+func clientOf(body interface{}) string {
+	if message, ok := body.(clientMessage); ok {
+		return message.clientID()
+	}
+	return ""
+}
+
+// sequenceKey is the key of the numbering of the messages of a client on a
+// stream.
+func sequenceKey(stream string, clientId string) string {
+	return stream + "@" + clientId
+}
+
+// stamp numbers message as the next one of the process for clientId on the
+// stream of exchange and key.
+func (m *Middleware) stamp(exchange string, key string, clientId string, message *Message) {
+	stream := exchange + "/" + key
+	sequence := sequenceKey(stream, clientId)
+
+	m.sequenceMutex.Lock()
+	m.sequences[sequence]++
+	identity := Identity{Producer: m.producerID, Stream: stream, ClientId: clientId, Sequence: m.sequences[sequence]}
+	m.sequenceMutex.Unlock()
+
+	if message.Headers == nil {
+		message.Headers = Headers{}
+	}
+	message.Headers[HeaderProducer] = identity.Producer
+	message.Headers[HeaderStream] = identity.Stream
+	message.Headers[HeaderSequence] = strconv.FormatInt(identity.Sequence, 10)
+	if clientId != "" {
+		message.Headers[HeaderClientID] = clientId
+	}
+	message.MessageId = identity.MessageId()
+}
+
+// Sequences returns the last number published for every client on every
+// stream, for a producer that resumes its input midway to checkpoint along
+// with it.
+func (m *Middleware) Sequences() map[string]int64 {
+	m.sequenceMutex.Lock()
+	defer m.sequenceMutex.Unlock()
+
+	return maps.Clone(m.sequences)
+}
+
+// SetSequences resumes the numbering of every client on every stream after
+// the numbers of a checkpoint. It must be set before publishing.
+func (m *Middleware) SetSequences(sequences map[string]int64) {
+	m.sequenceMutex.Lock()
+	defer m.sequenceMutex.Unlock()
+
+	m.sequences = maps.Clone(sequences)
+	if m.sequences == nil {
+		m.sequences = make(map[string]int64)
+	}
+}
@@ -0,0 +1,388 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+)
+
+var ErrClosed = errors.New("broker connection closed")
+
+// Memory is an in-process broker, to run the system without a RabbitMQ
+// server. Every Middleware gets its own connection from Connect, and they
+// all share the exchanges and queues of the Memory, which live as long as
+// it does.
+//
+// It follows the RabbitMQ semantics the Middleware relies on: topic
+// exchanges, messages routed to no queue are dropped, a queue hands its
+// messages round robin to its consumers up to DefaultPrefetch unacked each,
+// and the messages a connection did not ack are requeued when it is closed.
+type Memory struct {
+	mutex     sync.Mutex
+	exchanges map[string][]memoryBinding
+	queues    map[string]*memoryQueue
+	nextTag   uint64
+}
+
+type memoryBinding struct {
+	queue   string
+	pattern string
+}
+
+type memoryMessage struct {
+	Message
+	redelivered bool
+}
+
+type memoryQueue struct {
+	name        string
+	deadLetters string
+	ready       []*memoryMessage
+	consumers   []*memoryConsumer
+	next        int
+}
+
+type memoryConsumer struct {
+	queue      *memoryQueue
+	deliveries chan Delivery
+	unacked    map[uint64]*memoryMessage
+	// cancelled consumers get no more messages, but can still settle the
+	// ones they hold until the connection is closed
+	cancelled bool
+	closed    bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		exchanges: make(map[string][]memoryBinding),
+		queues:    make(map[string]*memoryQueue),
+	}
+}
+
+// Connect opens a connection to the broker.
+func (m *Memory) Connect() *MemoryConn {
+	return &MemoryConn{memory: m}
+}
+
+// MemoryConn is a connection to a Memory broker.
+type MemoryConn struct {
+	memory    *Memory
+	consumers []*memoryConsumer
+	closed    bool
+}
+
+func (c *MemoryConn) DeclareExchange(name string) error {
+	m := c.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if _, ok := m.exchanges[name]; !ok {
+		m.exchanges[name] = nil
+	}
+	return nil
+}
+
+// DeclareQueue declares the queue. The consumer timeout is not enforced, and
+// messages rejected without requeue are sent to the dead letter exchange.
+func (c *MemoryConn) DeclareQueue(name string, options QueueOptions) error {
+	m := c.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if _, ok := m.queues[name]; !ok {
+		m.queues[name] = &memoryQueue{name: name, deadLetters: options.DeadLetterExchange}
+	}
+	return nil
+}
+
+func (c *MemoryConn) BindQueue(queue string, key string, exchange string) error {
+	m := c.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	bindings, ok := m.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("no exchange %q", exchange)
+	}
+	if _, ok := m.queues[queue]; !ok {
+		return fmt.Errorf("no queue %q", queue)
+	}
+
+	binding := memoryBinding{queue: queue, pattern: key}
+	for _, existing := range bindings {
+		if existing == binding {
+			return nil
+		}
+	}
+
+	m.exchanges[exchange] = append(bindings, binding)
+	return nil
+}
+
+func (c *MemoryConn) Publish(exchange string, key string, message Message) error {
+	_, err := c.publish(exchange, key, message)
+	return err
+}
+
+// PublishAndWait publishes the message, which is in its queues as soon as it
+// returns.
+func (c *MemoryConn) PublishAndWait(exchange string, key string, message Message) error {
+	routed, err := c.publish(exchange, key, message)
+	if err != nil {
+		return err
+	}
+
+	if routed == 0 {
+		return ErrUnroutable
+	}
+	return nil
+}
+
+// PublishDeferred publishes the message, the channel holding its outcome
+// right away.
+func (c *MemoryConn) PublishDeferred(exchange string, key string, message Message) (<-chan error, error) {
+	done := make(chan error, 1)
+	done <- c.PublishAndWait(exchange, key, message)
+	return done, nil
+}
+
+// publish returns how many queues the message was routed to.
+func (c *MemoryConn) publish(exchange string, key string, message Message) (int, error) {
+	m := c.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	return m.route(exchange, key, message)
+}
+
+// route puts the message in the queues it matches. The caller must hold the
+// mutex.
+func (m *Memory) route(exchange string, key string, message Message) (int, error) {
+	var queues []string
+	if exchange == "" {
+		queues = []string{key}
+	} else {
+		bindings, ok := m.exchanges[exchange]
+		if !ok {
+			return 0, fmt.Errorf("no exchange %q", exchange)
+		}
+
+		matched := make(map[string]bool)
+		for _, binding := range bindings {
+			if !matched[binding.queue] && matchTopic(binding.pattern, key) {
+				matched[binding.queue] = true
+				queues = append(queues, binding.queue)
+			}
+		}
+	}
+
+	routed := 0
+	for _, name := range queues {
+		queue, ok := m.queues[name]
+		if !ok {
+			continue
+		}
+
+		copied := Message{
+			Body:        append([]byte(nil), message.Body...),
+			ContentType: message.ContentType,
+			MessageId:   message.MessageId,
+			Headers:     maps.Clone(message.Headers),
+		}
+		queue.ready = append(queue.ready, &memoryMessage{Message: copied})
+		m.dispatch(queue)
+		routed++
+	}
+
+	return routed, nil
+}
+
+func (c *MemoryConn) Consume(ctx context.Context, queue string) (<-chan Delivery, error) {
+	m := c.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	q, ok := m.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("no queue %q", queue)
+	}
+
+	consumer := &memoryConsumer{
+		queue: q,
+		// every delivery in the channel is unacked, so the prefetch bounds
+		// it and dispatch never blocks
+		deliveries: make(chan Delivery, DefaultPrefetch),
+		unacked:    make(map[uint64]*memoryMessage),
+	}
+	q.consumers = append(q.consumers, consumer)
+	c.consumers = append(c.consumers, consumer)
+	context.AfterFunc(ctx, func() { m.cancel(consumer) })
+
+	m.dispatch(q)
+	return consumer.deliveries, nil
+}
+
+// cancel stops handing messages to consumer and closes its deliveries.
+func (m *Memory) cancel(consumer *memoryConsumer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if consumer.cancelled || consumer.closed {
+		return
+	}
+	consumer.cancelled = true
+	close(consumer.deliveries)
+	consumer.queue.remove(consumer)
+}
+
+func (q *memoryQueue) remove(consumer *memoryConsumer) {
+	for i, other := range q.consumers {
+		if other == consumer {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close requeues the messages not acked through the connection, ahead of the
+// ones never delivered, and ends its consumers.
+func (c *MemoryConn) Close() error {
+	m := c.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	for _, consumer := range c.consumers {
+		if !consumer.cancelled {
+			close(consumer.deliveries)
+		}
+		consumer.closed = true
+
+		q := consumer.queue
+		q.remove(consumer)
+
+		tags := make([]uint64, 0, len(consumer.unacked))
+		for tag := range consumer.unacked {
+			tags = append(tags, tag)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+		requeued := make([]*memoryMessage, 0, len(tags))
+		for _, tag := range tags {
+			message := consumer.unacked[tag]
+			message.redelivered = true
+			requeued = append(requeued, message)
+		}
+		consumer.unacked = nil
+
+		q.ready = append(requeued, q.ready...)
+		m.dispatch(q)
+	}
+
+	return nil
+}
+
+// dispatch hands the ready messages of q to its consumers with room for
+// them. The caller must hold the mutex.
+func (m *Memory) dispatch(q *memoryQueue) {
+	for len(q.ready) > 0 {
+		consumer := q.nextConsumer()
+		if consumer == nil {
+			return
+		}
+
+		message := q.ready[0]
+		q.ready = q.ready[1:]
+
+		m.nextTag++
+		tag := m.nextTag
+		consumer.unacked[tag] = message
+
+		consumer.deliveries <- Delivery{
+			Message: Message{
+				Body:        message.Body,
+				ContentType: message.ContentType,
+				MessageId:   message.MessageId,
+				Headers:     maps.Clone(message.Headers),
+			},
+			Redelivered: message.redelivered,
+			ack:         func() error { return m.settle(consumer, tag, false, false) },
+			nack:        func(requeue bool) error { return m.settle(consumer, tag, true, requeue) },
+		}
+	}
+}
+
+// nextConsumer returns the next consumer round robin that holds fewer than
+// DefaultPrefetch unacked messages, or nil if all of them are full.
+func (q *memoryQueue) nextConsumer() *memoryConsumer {
+	for range q.consumers {
+		consumer := q.consumers[q.next%len(q.consumers)]
+		q.next = (q.next + 1) % len(q.consumers)
+
+		if len(consumer.unacked) < DefaultPrefetch {
+			return consumer
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) settle(consumer *memoryConsumer, tag uint64, nack bool, requeue bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if consumer.closed {
+		return ErrClosed
+	}
+
+	message, ok := consumer.unacked[tag]
+	if !ok {
+		return fmt.Errorf("delivery %d already acknowledged", tag)
+	}
+	delete(consumer.unacked, tag)
+
+	if nack && requeue {
+		message.redelivered = true
+		consumer.queue.ready = append([]*memoryMessage{message}, consumer.queue.ready...)
+	} else if nack && consumer.queue.deadLetters != "" {
+		// like RabbitMQ, record where the message died
+		dead := message.Message
+		dead.Headers = maps.Clone(dead.Headers)
+		if dead.Headers == nil {
+			dead.Headers = Headers{}
+		}
+		dead.Headers["x-first-death-queue"] = consumer.queue.name
+		dead.Headers["x-first-death-reason"] = "rejected"
+		m.route(consumer.queue.deadLetters, consumer.queue.name, dead)
+	}
+
+	m.dispatch(consumer.queue)
+	return nil
+}
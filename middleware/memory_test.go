@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"0", "0", true},
+		{"0", "1", false},
+		{"0.*", "0.Action", true},
+		{"0.*", "0", false},
+		{"0.*", "0.Action.Indie", false},
+		{"0.#", "0", true},
+		{"0.#", "0.Action.Indie", true},
+		{"0.#.Action.#", "0.Action", true},
+		{"0.#.Action.#", "0.Indie.Action.RPG", true},
+		{"0.#.Action.#", "0.Indie", false},
+		{"0.#.Action.#", "1.Action", false},
+		{"#", "", true},
+		{"#", "a.b.c", true},
+		{"*.b", "a.b", true},
+		{"*.b", "b", false},
+	}
+
+	for _, test := range tests {
+		if got := matchTopic(test.pattern, test.key); got != test.match {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", test.pattern, test.key, got, test.match)
+		}
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+
+	select {
+	case delivery, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return delivery
+	case <-time.After(time.Second):
+		t.Fatal("no delivery")
+	}
+	return Delivery{}
+}
+
+func nothing(t *testing.T, deliveries <-chan Delivery) {
+	t.Helper()
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("unexpected delivery %q", delivery.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// queue declares a queue bound to key on the "test" exchange.
+func queue(t *testing.T, conn *MemoryConn, name string, key string, options QueueOptions) {
+	t.Helper()
+
+	for _, err := range []error{
+		conn.DeclareExchange("test"),
+		conn.DeclareQueue(name, options),
+		conn.BindQueue(name, key, "test"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryAckNackRequeue(t *testing.T) {
+	conn := NewMemory().Connect()
+	defer conn.Close()
+	queue(t, conn, "q", "k", QueueOptions{})
+
+	deliveries, err := conn.Consume(context.Background(), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Publish("test", "k", Message{Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, deliveries)
+	if first.Redelivered {
+		t.Fatal("first delivery marked redelivered")
+	}
+	if err := first.Nack(true); err != nil {
+		t.Fatal(err)
+	}
+
+	again := receive(t, deliveries)
+	if string(again.Body) != "a" || !again.Redelivered {
+		t.Fatalf("requeued delivery = %q redelivered %v, want a redelivered", again.Body, again.Redelivered)
+	}
+	if err := again.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Ack(); err == nil {
+		t.Fatal("second ack of a delivery succeeded")
+	}
+
+	nothing(t, deliveries)
+}
+
+func TestMemoryNackDeadLetters(t *testing.T) {
+	conn := NewMemory().Connect()
+	defer conn.Close()
+	queue(t, conn, "q", "k", QueueOptions{DeadLetterExchange: "test"})
+	queue(t, conn, "dead", "q", QueueOptions{})
+
+	deliveries, err := conn.Consume(context.Background(), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := conn.Consume(context.Background(), "dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Publish("test", "k", Message{Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(t, deliveries).Nack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	letter := receive(t, dead)
+	if string(letter.Body) != "a" || letter.Headers["x-first-death-queue"] != "q" || letter.Headers["x-first-death-reason"] != "rejected" {
+		t.Fatalf("dead letter = %q %v", letter.Body, letter.Headers)
+	}
+	nothing(t, deliveries)
+}
+
+func TestMemoryCloseRequeuesUnacked(t *testing.T) {
+	memory := NewMemory()
+	first := memory.Connect()
+	queue(t, first, "q", "k", QueueOptions{})
+
+	deliveries, err := first.Consume(context.Background(), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"a", "b"} {
+		if err := first.Publish("test", "k", Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := receive(t, deliveries).Ack(); err != nil {
+		t.Fatal(err)
+	}
+	unacked := receive(t, deliveries)
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := unacked.Ack(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("ack after close = %v, want ErrClosed", err)
+	}
+
+	second := memory.Connect()
+	defer second.Close()
+	redeliveries, err := second.Consume(context.Background(), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redelivered := receive(t, redeliveries)
+	if string(redelivered.Body) != "b" || !redelivered.Redelivered {
+		t.Fatalf("after close got %q redelivered %v, want b redelivered", redelivered.Body, redelivered.Redelivered)
+	}
+	nothing(t, redeliveries)
+}
+
+func TestMemoryCancelClosesDeliveries(t *testing.T) {
+	conn := NewMemory().Connect()
+	defer conn.Close()
+	queue(t, conn, "q", "k", QueueOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries, err := conn.Consume(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Fatal("delivery after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deliveries not closed after cancel")
+	}
+}
+
+func TestMemoryPublishAndWaitUnroutable(t *testing.T) {
+	conn := NewMemory().Connect()
+	defer conn.Close()
+	queue(t, conn, "q", "k", QueueOptions{})
+
+	if err := conn.PublishAndWait("test", "k", Message{}); err != nil {
+		t.Fatalf("routed publish = %v", err)
+	}
+	if err := conn.PublishAndWait("test", "other", Message{}); !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("unroutable publish = %v, want ErrUnroutable", err)
+	}
+	if err := conn.Publish("test", "other", Message{}); err != nil {
+		t.Fatalf("unroutable publish without wait = %v, want it dropped", err)
+	}
+}
+
+// An end of stream to a shard without a queue is skipped right away.
+func TestBroadcastSkipsUnboundShardsWithoutRetrying(t *testing.T) {
+	m, err := NewMiddlewareWithBroker(NewMemory().Connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetPartitioner(Modulo(3))
+
+	if _, err := m.ListenStats("0", "Action"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := m.SendStatsFinished("a"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > publishRetryDelay {
+		t.Fatalf("broadcast took %v, unroutable shards were retried", elapsed)
+	}
+}
@@ -32,7 +32,11 @@ func NewGame(record []string) *Game {
 		return nil
 	}
 
-	year, err := strconv.Atoi(record[yearIndex][len(record[yearIndex])-4:])
+	date := record[yearIndex]
+	if len(date) < 4 {
+		return nil
+	}
+	year, err := strconv.Atoi(date[len(date)-4:])
 	if err != nil {
 		return nil
 	}
@@ -54,9 +58,11 @@ func NewGame(record []string) *Game {
 	return game
 }
 
+// GameMsg, ReviewsBatch, StatsMsg and Result carry the id of the client whose
+// dataset they belong to, so that concurrent clients never mix.
 type GameMsg struct {
-	Game *Game
-	Last bool
+	ClientId string
+	Game     *Game
 }
 
 type Review struct {
@@ -82,8 +88,8 @@ func NewReview(record []string) *Review {
 }
 
 type ReviewsBatch struct {
-	Reviews []Review
-	Last    int
+	ClientId string
+	Reviews  []Review
 }
 
 type Stats struct {
@@ -128,12 +134,13 @@ func NewStats(game []string, review *Review) *Stats {
 }
 
 type StatsMsg struct {
-	Id    int
-	Stats *Stats
-	Last  bool
+	ClientId string
+	Id       int64
+	Stats    *Stats
 }
 
 type Result struct {
+	ClientId       string
 	QueryId        int
 	IsFinalMessage bool
 	Payload        interface{}
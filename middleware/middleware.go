@@ -0,0 +1,305 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const consumerTimeout = 60 * time.Second
+
+// Attempts of publishAndWait, and the delay before the first retry, doubled
+// after every failed one.
+const (
+	publishAttempts   = 5
+	publishRetryDelay = 200 * time.Millisecond
+)
+
+type Middleware struct {
+	broker         Broker
+	reviewsQueue   string
+	responsesQueue string
+	errorHandler   ErrorHandler
+	maxAttempts    int
+	partitioner    Partitioner
+	codec          Codec
+	producerID     string
+	producers      map[string]int
+	eofStore       EOFStore
+
+	sequenceMutex sync.Mutex
+	sequences     map[string]int64
+
+	retryMutex sync.Mutex
+	retries    map[string]*retries
+	// retryRun tells the retries of the process from the ones sent before a
+	// restart with the same producer id.
+	retryRun int64
+
+	games     *Publisher[GameMsg]
+	reviews   *Publisher[ReviewsBatch]
+	stats     *Publisher[StatsMsg]
+	responses *Publisher[Result]
+}
+
+// NewMiddleware connects to the RabbitMQ server of the deployment, with
+// publisher confirms. It partitions as configured by the SHARDS, PARTITIONER
+// and PARTITION_RANGE_MAX env vars, publishes with the codec named by CODEC,
+// and reads its producer id and the producers of every stream from
+// PRODUCER_ID and <STREAM>_PRODUCERS.
+func NewMiddleware() (*Middleware, error) {
+	partitioner, err := partitionerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := codecFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	producerID, err := producerIDFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	producers, err := producersFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	broker, err := DialAMQP(DefaultURL, AMQPOptions{Confirms: true})
+	if err != nil {
+		return nil, err
+	}
+
+	middleware, err := NewMiddlewareWithBroker(broker)
+	if err != nil {
+		return nil, err
+	}
+	middleware.SetPartitioner(partitioner)
+	middleware.SetCodec(codec)
+	middleware.SetProducerID(producerID)
+	for stream, n := range producers {
+		middleware.SetProducers(stream, n)
+	}
+
+	return middleware, nil
+}
+
+// NewMiddlewareWithBroker declares the exchanges and queues of the system on
+// broker, partitions by modulo over DefaultShards, publishes gob and keeps
+// the end of stream states in memory. The Middleware owns the broker and
+// closes it on Close.
+func NewMiddlewareWithBroker(broker Broker) (*Middleware, error) {
+	middleware := &Middleware{
+		broker:       broker,
+		errorHandler: logError,
+		maxAttempts:  DefaultMaxAttempts,
+		partitioner:  Modulo(DefaultShards),
+		codec:        GobCodec,
+		producerID:   defaultProducerID(),
+		producers:    make(map[string]int),
+		eofStore:     newMemoryEOFStore(),
+		sequences:    make(map[string]int64),
+		retries:      make(map[string]*retries),
+		retryRun:     time.Now().UnixNano(),
+	}
+
+	err := middleware.declare()
+	if err != nil {
+		broker.Close()
+		return nil, err
+	}
+
+	return middleware, nil
+}
+
+// NotifyState registers c to receive the connection state changes of the
+// broker. Brokers that never disconnect send nothing.
+func (m *Middleware) NotifyState(c chan<- ConnectionEvent) {
+	if notifier, ok := m.broker.(StateNotifier); ok {
+		notifier.NotifyState(c)
+	}
+}
+
+func (m *Middleware) Close() error {
+	return m.broker.Close()
+}
+
+// encode encodes body with the codec of the Middleware.
+func (m *Middleware) encode(body interface{}) (Message, error) {
+	encoded, err := m.codec.Encode(body)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{Body: encoded, ContentType: m.codec.ContentType()}, nil
+}
+
+func (m *Middleware) publishExchange(exchange string, key string, body interface{}) error {
+	message, err := m.encode(body)
+	if err != nil {
+		return &PublishError{Exchange: exchange, Key: key, Err: err}
+	}
+	m.stamp(exchange, key, clientOf(body), &message)
+
+	err = m.broker.Publish(exchange, key, message)
+	if err != nil {
+		return &PublishError{Exchange: exchange, Key: key, Err: err}
+	}
+
+	return nil
+}
+
+// publishAndWait publishes like publishExchange, but waits for the broker to
+// take the message into a queue, retrying with backoff. It is meant for the
+// messages the pipeline cannot lose, like the end of stream markers. A retry
+// after a timeout may deliver the message twice. An unroutable message is not
+// retried, since nothing changes the bindings in the meantime.
+func (m *Middleware) publishAndWait(exchange string, key string, body interface{}) error {
+	message, err := m.encode(body)
+	if err != nil {
+		return &PublishError{Exchange: exchange, Key: key, Err: err}
+	}
+	m.stamp(exchange, key, clientOf(body), &message)
+
+	return m.publishMessageAndWait(exchange, key, message)
+}
+
+func (m *Middleware) publishMessageAndWait(exchange string, key string, message Message) error {
+	delay := publishRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := m.broker.PublishAndWait(exchange, key, message)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrClosed) || errors.Is(err, ErrNoConfirms) || errors.Is(err, ErrUnroutable) || attempt == publishAttempts {
+			return &PublishError{Exchange: exchange, Key: key, Err: err}
+		}
+
+		log.Printf("Failed to publish message to %q with key %q, attempt %d: %v", exchange, key, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// publishAllAndWait publishes every body to the key key returns for it
+// without waiting, and then waits for the broker to take all of them. It
+// makes a single attempt per message and fails if any of them was not taken,
+// the others may have been.
+func (m *Middleware) publishAllAndWait(exchange string, bodies []interface{}, key func(i int) string) error {
+	type deferred struct {
+		key  string
+		done <-chan error
+	}
+
+	pending := make([]deferred, 0, len(bodies))
+	for i, body := range bodies {
+		key := key(i)
+
+		message, err := m.encode(body)
+		if err != nil {
+			return &PublishError{Exchange: exchange, Key: key, Err: err}
+		}
+		m.stamp(exchange, key, clientOf(body), &message)
+
+		done, err := m.broker.PublishDeferred(exchange, key, message)
+		if err != nil {
+			return &PublishError{Exchange: exchange, Key: key, Err: err}
+		}
+		pending = append(pending, deferred{key: key, done: done})
+	}
+
+	timeout := time.After(confirmTimeout)
+	for _, publish := range pending {
+		select {
+		case err := <-publish.done:
+			if err != nil {
+				return &PublishError{Exchange: exchange, Key: publish.key, Err: err}
+			}
+		case <-timeout:
+			return &PublishError{Exchange: exchange, Key: publish.key, Err: ErrConfirmTimeout}
+		}
+	}
+
+	return nil
+}
+
+func (m *Middleware) publishQueue(queue string, body interface{}) error {
+	return m.publishExchange("", queue, body)
+}
+
+// consumeQueue consumes queue until ctx is done. The channel is closed once
+// the messages delivered before are handed out, so a Consume loop that ranges
+// over it finishes its in-flight callbacks and then returns. The loops cancel
+// ctx when they return early, which frees the consumer.
+func (m *Middleware) consumeQueue(ctx context.Context, queue string) (<-chan Delivery, error) {
+	msgs, err := m.broker.Consume(ctx, queue)
+	if err != nil {
+		return nil, &TopologyError{Kind: "consumer", Name: queue, Err: err}
+	}
+
+	return msgs, nil
+}
+
+func (m *Middleware) bindExchange(exchange string, key string) (string, error) {
+	err := m.broker.DeclareQueue(key, QueueOptions{
+		ConsumerTimeout:    consumerTimeout,
+		DeadLetterExchange: DeadLettersExchange,
+	})
+	if err != nil {
+		return "", &TopologyError{Kind: "queue", Name: key, Err: err}
+	}
+
+	err = m.broker.BindQueue(key, key, exchange)
+	if err != nil {
+		return "", &TopologyError{Kind: "binding", Name: exchange + " " + key, Err: err}
+	}
+
+	return key, nil
+}
+
+// bindEOF also binds queue to the key its end of stream messages are sent
+// with.
+func (m *Middleware) bindEOF(queue string, exchange string, key string) error {
+	err := m.broker.BindQueue(queue, key, exchange)
+	if err != nil {
+		return &TopologyError{Kind: "binding", Name: exchange + " " + key, Err: err}
+	}
+
+	return nil
+}
+
+func (m *Middleware) report(err error) {
+	m.errorHandler(err)
+}
+
+// decode decodes the body of msg into message, with the codec named by its
+// content type. A message that does not decode is reported and
+// dead-lettered.
+func (m *Middleware) decode(queue string, msg Delivery, message interface{}) bool {
+	codec, err := CodecFor(msg.ContentType)
+	if err == nil {
+		err = codec.Decode(msg.Body, message)
+	}
+	if err == nil {
+		return true
+	}
+
+	decodeErr := &DecodeError{Queue: queue, Err: err}
+	m.report(decodeErr)
+	m.deadLetter(queue, msg, attempts(msg.Headers)+1, decodeErr.Error())
+	return false
+}
+
+// acker returns the ack handed to the callbacks for msg.
+func (m *Middleware) acker(msg Delivery) func() {
+	return func() {
+		if err := msg.Ack(); err != nil {
+			m.report(err)
+		}
+	}
+}
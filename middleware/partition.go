@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// DefaultShards is the number of shards when none is configured.
+const DefaultShards = 3
+
+// Partitioning strategies, as named in the PARTITIONER env var.
+const (
+	StrategyModulo         = "modulo"
+	StrategyConsistentHash = "consistent-hash"
+	StrategyRange          = "range"
+)
+
+// virtualNodes is how many points every shard has on the consistent hash
+// ring, so the keys spread evenly.
+const virtualNodes = 128
+
+// Partitioner maps the key of a message, an app id, to the shard that
+// handles it.
+type Partitioner interface {
+	Shard(key string) int
+	// Shards is the number of shards, numbered from 0.
+	Shards() int
+}
+
+// NewPartitioner returns the partitioner of strategy over shards. The range
+// strategy splits the keys from 0 to rangeMax, the others ignore it.
+func NewPartitioner(strategy string, shards int, rangeMax int) (Partitioner, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("invalid shard count %d", shards)
+	}
+
+	switch strategy {
+	case "", StrategyModulo:
+		return Modulo(shards), nil
+	case StrategyConsistentHash:
+		return NewConsistentHash(shards), nil
+	case StrategyRange:
+		if rangeMax < 1 {
+			return nil, fmt.Errorf("range partitioner needs a positive maximum key, got %d", rangeMax)
+		}
+		return NewRange(shards, rangeMax), nil
+	}
+
+	return nil, fmt.Errorf("unknown partitioning strategy %q", strategy)
+}
+
+// partitionerFromEnv reads the partitioner from the SHARDS, PARTITIONER and
+// PARTITION_RANGE_MAX env vars.
+func partitionerFromEnv() (Partitioner, error) {
+	shards := DefaultShards
+	if value := os.Getenv("SHARDS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SHARDS %q", value)
+		}
+		shards = parsed
+	}
+
+	rangeMax := 0
+	if value := os.Getenv("PARTITION_RANGE_MAX"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PARTITION_RANGE_MAX %q", value)
+		}
+		rangeMax = parsed
+	}
+
+	return NewPartitioner(os.Getenv("PARTITIONER"), shards, rangeMax)
+}
+
+// SetPartitioner replaces the partitioner of the producers and of the end of
+// stream broadcasts. Every process of the system must use the same one.
+func (m *Middleware) SetPartitioner(partitioner Partitioner) {
+	m.partitioner = partitioner
+}
+
+// Modulo sends a numeric key to the shard key % shards, and any other key by
+// its hash.
+type Modulo int
+
+func (p Modulo) Shard(key string) int {
+	n, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return int(hash(key) % uint64(p))
+	}
+	return int(n % uint64(p))
+}
+
+func (p Modulo) Shards() int {
+	return int(p)
+}
+
+// ConsistentHash places the shards on a hash ring, and a key goes to the
+// first shard after its hash. Adding a shard only moves the keys it takes
+// from the others.
+type ConsistentHash struct {
+	shards int
+	points []uint64
+	owners map[uint64]int
+}
+
+func NewConsistentHash(shards int) *ConsistentHash {
+	ring := &ConsistentHash{shards: shards, owners: make(map[uint64]int)}
+
+	for shard := range shards {
+		for node := range virtualNodes {
+			point := hash(strconv.Itoa(shard) + "-" + strconv.Itoa(node))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = shard
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+
+	return ring
+}
+
+func (p *ConsistentHash) Shard(key string) int {
+	h := hash(key)
+	i := sort.Search(len(p.points), func(i int) bool { return p.points[i] >= h })
+	if i == len(p.points) {
+		i = 0
+	}
+	return p.owners[p.points[i]]
+}
+
+func (p *ConsistentHash) Shards() int {
+	return p.shards
+}
+
+// Range splits the numeric keys from 0 to max in equal contiguous ranges,
+// one per shard. Keys past max go to the last shard, and keys that are not
+// numbers are spread by their hash.
+type Range struct {
+	shards int
+	width  uint64
+}
+
+func NewRange(shards int, max int) *Range {
+	width := (uint64(max) + uint64(shards) - 1) / uint64(shards)
+	return &Range{shards: shards, width: width}
+}
+
+func (p *Range) Shard(key string) int {
+	n, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return int(hash(key) % uint64(p.shards))
+	}
+	return int(min(n/p.width, uint64(p.shards-1)))
+}
+
+func (p *Range) Shards() int {
+	return p.shards
+}
+
+// hash is FNV-1a followed by the splitmix64 finalizer, FNV alone leaves short
+// keys that differ in one character close together on the ring.
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"context"
+	"log"
+)
+
+// EndOfStream says which end of stream messages end a Queue.
+type EndOfStream struct {
+	// Producers is how many producers send their end of stream to the
+	// queue. The stream ends once all of them did.
+	Producers int
+	// Consumers is how many consumers share the queue, each of which must
+	// see the end of stream of every producer. 1 when it is not shared.
+	Consumers int
+}
+
+// Queue is a queue of messages of type T.
+type Queue[T any] struct {
+	name       string
+	middleware *Middleware
+	end        *endOfStream
+	onEnd      func(clientId string) error
+}
+
+// ListenQueue declares the queue bound to exchange with key, or the queue
+// named key for the "" exchange, and returns it. A nil end drops the end of
+// stream messages.
+func ListenQueue[T any](m *Middleware, exchange string, key string, end *EndOfStream) (*Queue[T], error) {
+	name := key
+	if exchange != "" {
+		var err error
+		name, err = m.bindExchange(exchange, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	queue := &Queue[T]{name: name, middleware: m}
+	if end != nil {
+		queue.end = newEndOfStream(name, end)
+	}
+
+	return queue, nil
+}
+
+// OnEnd sets what the Queue does once the stream of a client ended, before
+// acking its last end of stream: commit the messages of the client not acked
+// yet, and pass the end of stream downstream. It runs once per client, even
+// across restarts, if the EOFStore of the Middleware persists.
+func (q *Queue[T]) OnEnd(fn func(clientId string) error) {
+	q.onEnd = fn
+}
+
+// Consume hands the messages to callback until ctx is done. A callback that
+// fails without acking has its message retried, and dead-lettered after too
+// many attempts.
+func (q *Queue[T]) Consume(ctx context.Context, callback func(message *T, ack func()) error) error {
+	return q.ConsumeIdentified(ctx, func(message *T, _ Identity, ack func()) error {
+		return callback(message, ack)
+	})
+}
+
+// ConsumeIdentified is Consume handing each message along with its identity,
+// for idempotent processing. The identity is zero for the messages published
+// without one.
+func (q *Queue[T]) ConsumeIdentified(ctx context.Context, callback func(message *T, identity Identity, ack func()) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	msgs, err := q.middleware.consumeQueue(ctx, q.name)
+	if err != nil {
+		return err
+	}
+
+	for msg := range msgs {
+		if isEOF(msg) {
+			err := q.endOfStream(msg)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var message T
+		if !q.middleware.decode(q.name, msg, &message) {
+			continue
+		}
+
+		identity, _ := msg.Identity()
+		q.middleware.handle(q.name, msg, func(ack func()) error {
+			return callback(&message, identity, ack)
+		})
+	}
+
+	return nil
+}
+
+// endOfStream handles an end of stream message and acks it. On error it is
+// left unacked, to be handled again after a restart.
+func (q *Queue[T]) endOfStream(msg Delivery) error {
+	if q.end == nil {
+		q.middleware.acker(msg)()
+		return nil
+	}
+
+	deferred, err := q.middleware.deferEOF(q.name, msg)
+	if err != nil || deferred {
+		return err
+	}
+
+	clientId, ended, err := q.middleware.handleEOF(q.end, msg)
+	if err != nil {
+		return err
+	}
+	if !ended {
+		q.middleware.acker(msg)()
+		return nil
+	}
+
+	log.Printf("End of stream of client %q on %s", clientId, q.name)
+
+	if q.onEnd != nil {
+		err := q.onEnd(clientId)
+		if err != nil {
+			return err
+		}
+	}
+
+	state, err := q.end.state(q.middleware.eofStore, clientId)
+	if err != nil {
+		return err
+	}
+	err = q.end.propagated(q.middleware.eofStore, clientId, state)
+	if err != nil {
+		return err
+	}
+
+	q.middleware.acker(msg)()
+	return nil
+}
+
+// Publisher publishes messages of type T to an exchange, with the routing key
+// key returns for each of them.
+type Publisher[T any] struct {
+	exchange   string
+	key        func(message *T) string
+	middleware *Middleware
+}
+
+// NewPublisher returns a publisher to exchange. For the "" exchange key
+// returns the name of the queue.
+func NewPublisher[T any](m *Middleware, exchange string, key func(message *T) string) *Publisher[T] {
+	return &Publisher[T]{exchange: exchange, key: key, middleware: m}
+}
+
+func (p *Publisher[T]) Publish(message *T) error {
+	return p.middleware.publishExchange(p.exchange, p.key(message), message)
+}
+
+// PublishAllAndWait publishes the messages and waits for the broker to take
+// every one of them, see Middleware.publishAllAndWait.
+func (p *Publisher[T]) PublishAllAndWait(messages []*T) error {
+	bodies := make([]interface{}, len(messages))
+	for i, message := range messages {
+		bodies[i] = message
+	}
+
+	return p.middleware.publishAllAndWait(p.exchange, bodies, func(i int) string {
+		return p.key(messages[i])
+	})
+}
+
+// PublishAndWait publishes message and waits for the broker to take it, see
+// Middleware.publishAndWait.
+func (p *Publisher[T]) PublishAndWait(message *T) error {
+	return p.middleware.publishAndWait(p.exchange, p.key(message), message)
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/LucasAlda/demo-falopa/middleware"
@@ -13,6 +18,9 @@ const CANT_REVIEWS = 30_000
 const CANT_GAMES = 10_000
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	middleware, err := middleware.NewMiddleware()
 	if err != nil {
 		panic(err)
@@ -20,9 +28,20 @@ func main() {
 
 	defer middleware.Close()
 
-	time.Sleep(5 * time.Second)
+	select {
+	case <-time.After(5 * time.Second):
+	case <-ctx.Done():
+		return
+	}
 
-	seedDB(middleware)
+	err = seedDB(ctx, middleware, clientID())
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Interrupted, stopped seeding")
+		return
+	}
+	if err != nil {
+		log.Fatalf("failed to seed: %v", err)
+	}
 }
 
 type Game struct {
@@ -31,15 +50,30 @@ type Game struct {
 	Last  bool `json:"last"`
 }
 
-func seedDB(m *middleware.Middleware) error {
+// clientID returns the CLIENT_ID env var, or a new id for every run. The id
+// of a client whose results were sent is never reused.
+func clientID() string {
+	if id := os.Getenv("CLIENT_ID"); id != "" {
+		return id
+	}
+	return fmt.Sprintf("seeder-%d", time.Now().UnixNano())
+}
 
+// seedDB sends the stats of a client, stopping without the finished message
+// when ctx is done.
+func seedDB(ctx context.Context, m *middleware.Middleware, clientId string) error {
 	for i := 1; i <= CANT_REVIEWS; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		if i%10_000 == 0 {
 			fmt.Printf("Seeding %d reviews\n", i)
 		}
 
 		body := middleware.StatsMsg{
-			Id: i,
+			ClientId: clientId,
+			Id:       int64(i),
 			Stats: &middleware.Stats{
 				AppId:     1,
 				Name:      "Really Long Game Name here 2077: Deluxe Edition",
@@ -56,8 +90,8 @@ func seedDB(m *middleware.Middleware) error {
 		}
 	}
 
-	log.Printf("Sending finished message, sent %d msgs", CANT_REVIEWS)
-	err := m.SendStatsFinished()
+	log.Printf("Sending finished message of client %s, sent %d msgs", clientId, CANT_REVIEWS)
+	err := m.SendStatsFinished(clientId)
 	if err != nil {
 		return err
 	}
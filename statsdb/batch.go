@@ -0,0 +1,149 @@
+package statsdb
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/crash"
+	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/txn"
+)
+
+// Batch groups the updates of several messages into a single transaction. It
+// is committed once it holds size messages or timeout after its first one,
+// and only then are the messages acked.
+type Batch struct {
+	mutex   sync.Mutex
+	db      *DB
+	size    int
+	timeout time.Duration
+	tx      *txn.Tx[middleware.Stats]
+	ids     map[ProcessedID]bool
+	acks    []func()
+	timer   *time.Timer
+	// failed is the error of a failed commit, returned to every later call
+	// since the commit may be partially applied.
+	failed error
+}
+
+// NewBatch returns a Batch committing to db. A size of 1 commits every
+// message on its own.
+func NewBatch(db *DB, size int, timeout time.Duration) *Batch {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &Batch{db: db, size: size, timeout: timeout}
+}
+
+// Process adds the message to the stats exactly once, deduplicated by its
+// Id. A message that was already processed, or is already part of the batch,
+// is acked right away. An error means a commit failed and may be partially
+// applied, the caller must restart so Recover rolls it forward before the
+// messages are redelivered. A commit that failed on the timeout fails the
+// next call.
+func (b *Batch) Process(message *middleware.StatsMsg, ack func()) error {
+	return b.process(ProcessedID{Producer: Producer, Id: message.Id}, message, ack)
+}
+
+// ProcessIdentified is Process deduplicating by the identity the middleware
+// stamped on the message instead, if it has one.
+func (b *Batch) ProcessIdentified(identity middleware.Identity, message *middleware.StatsMsg, ack func()) error {
+	if identity.Sequence == 0 {
+		return b.Process(message, ack)
+	}
+	return b.process(ProcessedID{Producer: identity.Source(), Id: identity.Sequence}, message, ack)
+}
+
+func (b *Batch) process(id ProcessedID, message *middleware.StatsMsg, ack func()) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failed != nil {
+		return b.failed
+	}
+
+	if b.db.Processed.Contains(id) {
+		ack()
+		return nil
+	}
+
+	if b.tx == nil {
+		b.tx = b.db.Transactions.Begin()
+		b.ids = make(map[ProcessedID]bool)
+		b.timer = time.AfterFunc(b.timeout, b.flushTimeout)
+	}
+
+	if b.ids[id] {
+		ack()
+		return nil
+	}
+
+	err := b.tx.Update(strconv.Itoa(message.Stats.AppId), func(stat middleware.Stats, ok bool) middleware.Stats {
+		stat.Name = message.Stats.Name
+		stat.Positives += message.Stats.Positives
+		stat.Negatives += message.Stats.Negatives
+		return stat
+	})
+	if err != nil {
+		return err
+	}
+
+	b.tx.SetMeta(ProcessedMeta, id.String())
+	b.ids[id] = true
+	b.acks = append(b.acks, ack)
+
+	if len(b.acks) >= b.size {
+		return b.flush()
+	}
+
+	return nil
+}
+
+// Flush commits the current batch, if any, and acks its messages.
+func (b *Batch) Flush() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.flush()
+}
+
+// flushTimeout commits the batch from the timer, which has no caller to
+// return an error to, so the next Process or Flush gets it.
+func (b *Batch) flushTimeout() {
+	err := b.Flush()
+	if err != nil {
+		log.Printf("failed to commit on timeout: %v", err)
+	}
+}
+
+func (b *Batch) flush() error {
+	if b.failed != nil {
+		return b.failed
+	}
+	if b.tx == nil {
+		return nil
+	}
+
+	b.timer.Stop()
+
+	tx, acks := b.tx, b.acks
+	b.tx = nil
+	b.ids = nil
+	b.acks = nil
+
+	err := tx.Commit()
+	if err != nil {
+		b.failed = err
+		return err
+	}
+
+	for _, ack := range acks {
+		crash.Point(crash.Ack)
+		ack()
+	}
+
+	return nil
+}
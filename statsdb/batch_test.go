@@ -0,0 +1,45 @@
+package statsdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/middleware"
+)
+
+func stats(id int64) *middleware.StatsMsg {
+	return &middleware.StatsMsg{Id: id, Stats: &middleware.Stats{AppId: 1, Name: "Game", Positives: 1}}
+}
+
+// A commit that fails on the timeout fails the next Process and Flush, and
+// acks none of its messages.
+func TestBatchTimeoutErrorFailsNextCall(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	batch := NewBatch(db, 10, 10*time.Millisecond)
+	acked := false
+	if err := batch.Process(stats(1), func() { acked = true }); err != nil {
+		t.Fatal(err)
+	}
+	// the WAL refuses the commit of the timer
+	if err := db.Commits.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := batch.Process(stats(2), func() {}); err == nil {
+		t.Fatal("Process after a failed timeout commit succeeded")
+	}
+	if err := batch.Flush(); err == nil {
+		t.Fatal("Flush after a failed timeout commit succeeded")
+	}
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	if acked {
+		t.Fatal("message of the failed commit acked")
+	}
+}
@@ -0,0 +1,227 @@
+package statsdb
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+// clientPrefix starts the directory of every client database, so the one of
+// the messages without a client is not empty.
+const clientPrefix = "client-"
+
+// finishedFile lists the clients whose results were sent.
+const finishedFile = "finished.log"
+
+// ErrClientFinished is returned for the clients whose results were already
+// sent, which no message can change anymore.
+var ErrClientFinished = errors.New("client already finished")
+
+// Clients is a DB per client, each in its own directory of root, so the stats
+// and processed ids of concurrent clients never mix.
+type Clients struct {
+	mutex   sync.Mutex
+	root    string
+	options Options
+	dbs     map[string]*DB
+	// finished are the tombstones of the clients removed.
+	finished *durability.Set
+}
+
+// OpenClients opens the client databases in root lazily, creating root if
+// needed.
+func OpenClients(root string, options Options) (*Clients, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	finished, err := durability.OpenSet(filepath.Join(root, finishedFile))
+	if err != nil {
+		return nil, err
+	}
+
+	// the databases of the clients removed right before a crash
+	for _, clientId := range finished.Entries() {
+		err := os.RemoveAll(ClientPath(root, clientId))
+		if err != nil {
+			finished.Close()
+			return nil, err
+		}
+	}
+
+	return &Clients{root: root, options: options, dbs: make(map[string]*DB), finished: finished}, nil
+}
+
+// AdoptLegacy moves the database root held before the clients, every entry
+// of root but skip, into the database of the messages without a client. Once
+// opened its WAL is rolled forward, its legacy ids migrated and its temp
+// files removed like any other. It reports whether anything was moved, and
+// can be run again after a crash halfway.
+func (c *Clients) AdoptLegacy(root string, skip ...string) (bool, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return false, err
+	}
+
+	target := ClientPath(c.root, "")
+	moved := false
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if slices.Contains(skip, entry.Name()) || path == filepath.Clean(c.root) {
+			continue
+		}
+
+		err := os.MkdirAll(target, 0755)
+		if err != nil {
+			return moved, err
+		}
+
+		destination := filepath.Join(target, entry.Name())
+		if _, err := os.Lstat(destination); err == nil {
+			return moved, fmt.Errorf("cannot move %s, %s already exists", path, destination)
+		}
+
+		err = os.Rename(path, destination)
+		if err != nil {
+			return moved, err
+		}
+		moved = true
+	}
+
+	if moved {
+		err = durability.SyncDir(root)
+		if err == nil {
+			err = durability.SyncDir(target)
+		}
+	}
+	return moved, err
+}
+
+// ClientPath is the directory of the database of a client in root.
+func ClientPath(root string, clientId string) string {
+	return filepath.Join(root, clientPrefix+url.PathEscape(clientId))
+}
+
+// List returns the clients with a database in root.
+func (c *Clients) List() ([]string, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []string
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), clientPrefix)
+		if !ok || !entry.IsDir() {
+			continue
+		}
+
+		clientId, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		clients = append(clients, clientId)
+	}
+
+	return clients, nil
+}
+
+// Finished reports whether the client was removed, once its results were
+// sent.
+func (c *Clients) Finished(clientId string) bool {
+	return c.finished.Contains(clientId)
+}
+
+// Get returns the database of a client, opening and recovering it the first
+// time. It fails with ErrClientFinished for the clients removed.
+func (c *Clients) Get(clientId string) (*DB, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.finished.Contains(clientId) {
+		return nil, ErrClientFinished
+	}
+
+	if db, ok := c.dbs[clientId]; ok {
+		return db, nil
+	}
+
+	db, err := Open(ClientPath(c.root, clientId), c.options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Recover()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c.dbs[clientId] = db
+	return db, nil
+}
+
+// Remove closes the database of a client and deletes it, once its results
+// were delivered. A tombstone of the client is kept, so its late messages
+// find it finished instead of starting a new database.
+func (c *Clients) Remove(clientId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.finished.Add(clientId)
+	if err != nil {
+		return err
+	}
+
+	if db, ok := c.dbs[clientId]; ok {
+		delete(c.dbs, clientId)
+		err := db.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(ClientPath(c.root, clientId))
+}
+
+// LogCacheStats logs the counters of the stats cache of every open client
+// database every interval.
+func (c *Clients) LogCacheStats(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		c.mutex.Lock()
+		for clientId, db := range c.dbs {
+			db.logCacheStats(fmt.Sprintf("Cache of client %q", clientId))
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (c *Clients) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var err error
+	for clientId, db := range c.dbs {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		delete(c.dbs, clientId)
+	}
+
+	if closeErr := c.finished.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,200 @@
+package statsdb
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/store"
+)
+
+// legacyCommitEnd closes every complete block of a legacy commit file.
+const legacyCommitEnd = "END"
+
+// replayLegacyCommit rolls forward the last complete block of the commit file
+// of the workers that predate the WAL, and removes the file. Each row of a
+// block is `appId,messageId,tempPath`, the temp file holding the whole new
+// `appId,name,positives,negatives` record of the stats. A row whose temp file
+// is gone was renamed in place before the crash, and its id reached
+// processed.bin, so only the rows whose temp file is left are replayed, each
+// in a transaction that also marks its message processed. A block without its
+// END never got its temp files renamed and is dropped, like the legacy worker
+// did. It returns how many rows were replayed.
+func (db *DB) replayLegacyCommit() (int, error) {
+	path := filepath.Join(db.Path, legacyCommit)
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	file.Close()
+	if err != nil {
+		log.Printf("Discarding unreadable %s: %v", path, err)
+		records = nil
+	}
+
+	var block [][]string
+	if end := len(records) - 1; end >= 0 && records[end][0] == legacyCommitEnd {
+		start := end
+		for start > 0 && records[start-1][0] != legacyCommitEnd {
+			start--
+		}
+		block = records[start:end]
+	}
+
+	replayed := 0
+	for _, row := range block {
+		ok, err := db.replayLegacyRow(row)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to replay %s: %w", path, err)
+		}
+		if ok {
+			replayed++
+		}
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return replayed, err
+	}
+
+	return replayed, durability.SyncDir(db.Path)
+}
+
+func (db *DB) replayLegacyRow(row []string) (bool, error) {
+	if len(row) != 3 {
+		return false, fmt.Errorf("invalid commit row: %v", row)
+	}
+
+	id, err := strconv.ParseInt(row[1], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("failed to convert id to int: %w", err)
+	}
+
+	// the temp file was created in the database root, wherever the root was
+	tempPath := filepath.Join(db.Path, filepath.Base(row[2]))
+
+	file, err := os.Open(tempPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	record, err := csv.NewReader(file).Read()
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", tempPath, err)
+	}
+	if len(record) != 4 || record[0] != row[0] {
+		return false, fmt.Errorf("invalid stats record in %s: %v", tempPath, record)
+	}
+
+	stats, err := StatsCodec{}.Decode(record[1:])
+	if err != nil {
+		return false, err
+	}
+
+	tx := db.Transactions.Begin()
+	tx.Put(row[0], stats)
+	tx.SetMeta(ProcessedMeta, ProcessedID{Producer: Producer, Id: id}.String())
+
+	return true, tx.Commit()
+}
+
+// legacyStatsPattern matches the stats files of workers that predate the
+// store, one `<appId>.csv` per AppId in the stats directory.
+var legacyStatsPattern = regexp.MustCompile(`^[0-9]+\.csv$`)
+
+// importLegacyStats moves the per AppId stats files of the workers that
+// predate the store into stats, the hashmap that now lives in their
+// directory, and removes them once stats is synced. Each file holds a single
+// `appId,name,positives,negatives` record. A file is only removed after its
+// record is in stats, so a crash halfway imports the files left again. It
+// returns how many files were imported.
+func importLegacyStats(stats store.Store[middleware.Stats], dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || !legacyStatsPattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		appId, value, err := readLegacyStats(path)
+		if err != nil {
+			return 0, err
+		}
+		if appId+".csv" != entry.Name() {
+			return 0, fmt.Errorf("invalid stats record in %s: AppId %s", path, appId)
+		}
+
+		err = stats.Put(appId, value)
+		if err != nil {
+			return 0, err
+		}
+		paths = append(paths, path)
+	}
+
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	// a file removed before its record is synced would lose the stats
+	err = stats.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(paths), durability.SyncDir(dir)
+}
+
+func readLegacyStats(path string) (string, middleware.Stats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", middleware.Stats{}, err
+	}
+	defer file.Close()
+
+	record, err := csv.NewReader(file).Read()
+	if err != nil {
+		return "", middleware.Stats{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if len(record) != 4 {
+		return "", middleware.Stats{}, fmt.Errorf("invalid stats record in %s: %v", path, record)
+	}
+
+	stats, err := StatsCodec{}.Decode(record[1:])
+	if err != nil {
+		return "", middleware.Stats{}, fmt.Errorf("invalid stats record in %s: %w", path, err)
+	}
+
+	return record[0], stats, nil
+}
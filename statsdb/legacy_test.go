@@ -0,0 +1,114 @@
+package statsdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func write(t *testing.T, path string, data string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The last complete block of a legacy commit is rolled forward from its temp
+// files, the rows renamed in place before the crash are left alone.
+func TestOpenReplaysLegacyCommit(t *testing.T) {
+	path := t.TempDir()
+	write(t, filepath.Join(path, "7.csv123"), "7,Game,5,1\n")
+	write(t, filepath.Join(path, legacyCommit), "3,40,./database/3.csv1\nEND\n7,42,./database/7.csv123\n8,43,./database/8.csv9\nEND\n")
+
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stats, ok, err := db.Stats.Get("7")
+	if err != nil || !ok || stats.Name != "Game" || stats.Positives != 5 || stats.Negatives != 1 {
+		t.Fatalf("stats of 7 = %+v, %v, %v, want Game 5 1", stats, ok, err)
+	}
+	for _, key := range []string{"3", "8"} {
+		if _, ok, _ := db.Stats.Get(key); ok {
+			t.Errorf("stats of %s replayed, its temp file is gone", key)
+		}
+	}
+
+	if !db.Processed.Contains(ProcessedID{Producer: Producer, Id: 42}) {
+		t.Error("replayed message 42 not processed")
+	}
+	if _, err := os.Stat(filepath.Join(path, legacyCommit)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s left after the replay: %v", legacyCommit, err)
+	}
+}
+
+// A block without its END is dropped.
+func TestOpenDropsTornLegacyCommit(t *testing.T) {
+	path := t.TempDir()
+	write(t, filepath.Join(path, "7.csv123"), "7,Game,5,1\n")
+	write(t, filepath.Join(path, legacyCommit), "7,42,./database/7.csv123\n")
+
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, ok, _ := db.Stats.Get("7"); ok {
+		t.Error("stats of a block without END replayed")
+	}
+	if db.Processed.Contains(ProcessedID{Producer: Producer, Id: 42}) {
+		t.Error("message of a block without END processed")
+	}
+	if _, err := os.Stat(filepath.Join(path, legacyCommit)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s left: %v", legacyCommit, err)
+	}
+}
+
+// The per AppId stats files of a legacy database are imported into the
+// hashmap and removed, and the legacy commit is replayed over them.
+func TestOpenImportsLegacyStats(t *testing.T) {
+	path := t.TempDir()
+	dir := filepath.Join(path, statsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(dir, "3.csv"), "3,Other,2,0\n")
+	write(t, filepath.Join(dir, "7.csv"), "7,Game,4,1\n")
+	write(t, filepath.Join(path, "7.csv123"), "7,Game,5,1\n")
+	write(t, filepath.Join(path, legacyCommit), "7,42,./database/7.csv123\nEND\n")
+
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]int{"3": 2, "7": 5} {
+		stats, ok, err := db.Stats.Get(key)
+		if err != nil || !ok || stats.Positives != want {
+			t.Errorf("stats of %s = %+v, %v, %v, want %d positives", key, stats, ok, err, want)
+		}
+	}
+	for _, name := range []string{"3.csv", "7.csv"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left after the import: %v", name, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if stats, ok, _ := db.Stats.Get("3"); !ok || stats.Name != "Other" {
+		t.Fatalf("stats of 3 = %+v, %v after reopening", stats, ok)
+	}
+}
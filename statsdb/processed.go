@@ -0,0 +1,82 @@
+package statsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/LucasAlda/demo-falopa/dedup"
+)
+
+// ProcessedMeta is the transaction metadata holding the id of the message
+// the transaction processes.
+const ProcessedMeta = "processed"
+
+// Producer is the dedup producer of the stats messages published without an
+// identity, which all share the id sequence of StatsMsg.Id.
+const Producer = ""
+
+// ProcessedID is a message applied to the stats: the dedup producer that
+// numbered it and its id.
+type ProcessedID struct {
+	Producer string
+	Id       int64
+}
+
+// String is the processed metadata value of id, `<id>@<producer>`, or just
+// the id for Producer.
+func (id ProcessedID) String() string {
+	value := strconv.FormatInt(id.Id, 10)
+	if id.Producer == Producer {
+		return value
+	}
+	return value + "@" + id.Producer
+}
+
+// ParseProcessedID parses a processed metadata value.
+func ParseProcessedID(value string) (ProcessedID, error) {
+	number, producer, _ := strings.Cut(value, "@")
+
+	id, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return ProcessedID{}, fmt.Errorf("failed to convert id to int: %w", err)
+	}
+
+	return ProcessedID{Producer: producer, Id: id}, nil
+}
+
+// Processed tracks the ids of the messages already applied to the stats. It
+// applies the processed metadata of the transactions.
+type Processed struct {
+	tracker *dedup.Tracker
+}
+
+// Tracker returns the underlying tracker, to inspect every producer.
+func (p *Processed) Tracker() *dedup.Tracker {
+	return p.tracker
+}
+
+func (p *Processed) Contains(id ProcessedID) bool {
+	return p.tracker.Contains(id.Producer, id.Id)
+}
+
+func (p *Processed) ApplyMeta(name string, value string) error {
+	if name != ProcessedMeta {
+		return nil
+	}
+
+	id, err := ParseProcessedID(value)
+	if err != nil {
+		return err
+	}
+
+	return p.tracker.Add(id.Producer, id.Id)
+}
+
+func (p *Processed) Sync() error {
+	return p.tracker.Sync()
+}
+
+func (p *Processed) Close() error {
+	return p.tracker.Close()
+}
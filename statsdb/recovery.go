@@ -0,0 +1,101 @@
+package statsdb
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/store"
+)
+
+// legacyTempPattern matches the temp files of workers that predate the store,
+// created in the database root as `<appId>.csv<random>`.
+var legacyTempPattern = regexp.MustCompile(`^[0-9]+\.csv[0-9]+$`)
+
+// Recover rolls forward the transactions left in the WAL and then
+// removes the temp files of writes that never got renamed in place. A temp
+// file whose target was written by a rolled forward transaction has just been
+// superseded by the replay, any other one is an orphan of a write whose
+// transaction never reached the WAL or was already applied.
+func (db *DB) Recover() error {
+	recovery, err := db.Transactions.Recover()
+	if err != nil {
+		return err
+	}
+
+	replayed := make(map[string]bool)
+	if locator, ok := db.Stats.(store.Locator); ok {
+		for key := range recovery.Keys {
+			replayed[locator.Locate(key)] = true
+		}
+	}
+
+	temps, err := db.TempFiles()
+	if err != nil {
+		return err
+	}
+
+	superseded, orphans := 0, 0
+	var size int64
+
+	for _, temp := range temps {
+		err := os.Remove(temp.Path)
+		if err != nil {
+			log.Printf("failed to remove temp file %s: %v", temp.Path, err)
+			continue
+		}
+
+		if replayed[temp.Target] {
+			log.Printf("Removed temp file %s, superseded by the WAL replay of %s", temp.Path, temp.Target)
+			superseded++
+		} else {
+			log.Printf("Removed orphaned temp file %s", temp.Path)
+			orphans++
+		}
+		size += temp.Size
+	}
+
+	log.Printf("Recovery: rolled forward %d transactions, removed %d superseded and %d orphaned temp files (%d bytes)", recovery.Transactions, superseded, orphans, size)
+	return nil
+}
+
+// TempFiles returns the temp files left in the database by interrupted
+// writes, including the ones of legacy workers.
+func (db *DB) TempFiles() ([]durability.TempFile, error) {
+	temps, err := durability.FindTemp(db.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, err := findLegacyTemp(db.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(temps, legacy...), nil
+}
+
+func findLegacyTemp(root string) ([]durability.TempFile, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var temps []durability.TempFile
+	for _, entry := range entries {
+		if entry.IsDir() || !legacyTempPattern.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		temps = append(temps, durability.TempFile{Path: filepath.Join(root, entry.Name()), Size: info.Size()})
+	}
+
+	return temps, nil
+}
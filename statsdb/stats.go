@@ -0,0 +1,60 @@
+package statsdb
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/store"
+)
+
+// StatsCodec stores a Stats as `name,positives,negatives`, the AppId is the
+// store key.
+type StatsCodec struct{}
+
+func (StatsCodec) Encode(stats middleware.Stats) []string {
+	return []string{stats.Name, strconv.Itoa(stats.Positives), strconv.Itoa(stats.Negatives)}
+}
+
+func (StatsCodec) Decode(record []string) (middleware.Stats, error) {
+	if len(record) != 3 {
+		return middleware.Stats{}, fmt.Errorf("invalid stats record: %v", record)
+	}
+
+	positives, err := strconv.Atoi(record[1])
+	if err != nil {
+		return middleware.Stats{}, fmt.Errorf("failed to convert positives to int: %w", err)
+	}
+
+	negatives, err := strconv.Atoi(record[2])
+	if err != nil {
+		return middleware.Stats{}, fmt.Errorf("failed to convert negatives to int: %w", err)
+	}
+
+	return middleware.Stats{Name: record[0], Positives: positives, Negatives: negatives}, nil
+}
+
+// LogCacheStats logs the counters of the stats cache every interval. It
+// returns right away if the store has no cache.
+func (db *DB) LogCacheStats(interval time.Duration) {
+	if _, ok := db.Stats.(*store.Cache[middleware.Stats]); !ok {
+		return
+	}
+
+	for {
+		time.Sleep(interval)
+		db.logCacheStats("Cache")
+	}
+}
+
+func (db *DB) logCacheStats(name string) {
+	cache, ok := db.Stats.(*store.Cache[middleware.Stats])
+	if !ok {
+		return
+	}
+
+	counters := cache.Stats()
+	log.Printf("%s: %d entries, %d hits, %d misses, %d evictions", name, counters.Len, counters.Hits, counters.Misses, counters.Evictions)
+}
@@ -0,0 +1,141 @@
+package statsdb
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/LucasAlda/demo-falopa/dedup"
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/store"
+	"github.com/LucasAlda/demo-falopa/txn"
+	"github.com/LucasAlda/demo-falopa/wal"
+)
+
+// A stats database directory holds:
+//
+//	stats/          the stats store, keyed by AppId. Legacy `<appId>.csv`
+//	                files left in it are imported into the hashmap on open
+//	wal/            the transactions log
+//	processed/      the processed message ids
+//	processed.bin   legacy int32 processed ids, migrated on open
+//	commit.csv      legacy commit file, its last complete block replayed on
+//	                open
+const (
+	statsDir        = "stats"
+	walDir          = "wal"
+	processedDir    = "processed"
+	legacyProcessed = "processed.bin"
+	legacyCommit    = "commit.csv"
+)
+
+type Options struct {
+	// Backend is the store backend of the stats, hashmap by default.
+	Backend    string
+	Durability durability.Level
+	// CacheSize is the capacity of the stats cache, unused by the memory
+	// backend.
+	CacheSize int
+	// ReadOnly opens the stats, the WAL and the processed ids without
+	// changing them, for inspection. Legacy stats are not imported, legacy
+	// ids are not migrated and the legacy commit is not replayed.
+	ReadOnly bool
+	// Buckets is the bucket count of a new hashmap store, see
+	// store.Options.
+	Buckets int
+}
+
+// DB is the database of a stats worker: the stats store, the WAL that makes
+// its updates atomic and the ids of the messages already applied to it.
+type DB struct {
+	Path         string
+	Stats        store.Store[middleware.Stats]
+	Commits      *wal.WAL
+	Processed    *Processed
+	Transactions *txn.Manager[middleware.Stats]
+}
+
+// Open opens the database in path, creating it if needed. Transactions left
+// in the WAL are not rolled forward until Recover.
+func Open(path string, options Options) (*DB, error) {
+	db := &DB{Path: path}
+
+	stats, err := store.Open(options.Backend, filepath.Join(path, statsDir), store.Codec[middleware.Stats](StatsCodec{}), store.Options{Durability: options.Durability, ReadOnly: options.ReadOnly, Buckets: options.Buckets})
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Backend == store.BackendMemory {
+		db.Stats = stats
+	} else {
+		db.Stats = store.NewCache(stats, options.CacheSize)
+	}
+
+	db.Commits, err = wal.Open(filepath.Join(path, walDir), wal.Options{Durability: options.Durability, ReadOnly: options.ReadOnly})
+	if err != nil {
+		db.Stats.Close()
+		return nil, err
+	}
+
+	tracker, err := dedup.Open(filepath.Join(path, processedDir), dedup.Options{Durability: options.Durability, ReadOnly: options.ReadOnly})
+	if err != nil {
+		db.Commits.Close()
+		db.Stats.Close()
+		return nil, err
+	}
+	db.Processed = &Processed{tracker: tracker}
+	db.Transactions = txn.NewManager(db.Commits, db.Stats, store.Codec[middleware.Stats](StatsCodec{}), db.Processed)
+
+	if options.ReadOnly {
+		return db, nil
+	}
+
+	// the hashmap lives in the directory of the per AppId files it replaced,
+	// the files backend reads them in place. They are imported before the
+	// legacy commit, whose temp files are newer.
+	if options.Backend == store.BackendHashMap || options.Backend == "" {
+		imported, err := importLegacyStats(stats, filepath.Join(path, statsDir))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if imported > 0 {
+			log.Printf("Imported %d stats files into the %s store", imported, store.BackendHashMap)
+		}
+	}
+
+	// the legacy commit is replayed first, its ids are the last ones of
+	// processed.bin
+	replayed, err := db.replayLegacyCommit()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d stats from %s", replayed, legacyCommit)
+	}
+
+	legacyPath := filepath.Join(path, legacyProcessed)
+	migrated, err := tracker.MigrateLegacy(legacyPath, Producer)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if migrated > 0 {
+		log.Printf("Migrated %d ids from %s", migrated, legacyPath)
+	}
+
+	return db, nil
+}
+
+func (db *DB) Close() error {
+	err := db.Transactions.Checkpoint()
+
+	for _, closer := range []interface{ Close() error }{db.Processed, db.Commits, db.Stats} {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
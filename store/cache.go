@@ -0,0 +1,166 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+)
+
+const DefaultCacheSize = 10_000
+
+// CacheStats are the counters of a Cache since it was created.
+type CacheStats struct {
+	Hits      int
+	Misses    int
+	Evictions int
+	Len       int
+}
+
+type cacheEntry[V any] struct {
+	key   string
+	value V
+}
+
+// Cache keeps the most recently used values of the wrapped store in memory,
+// evicting the least recently used one past its capacity. It is write
+// through: writes go to the store first and the cache only keeps values the
+// store accepted, so it never disagrees with what the commit log applied.
+type Cache[V any] struct {
+	mutex    sync.Mutex
+	store    Store[V]
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	stats    CacheStats
+}
+
+func NewCache[V any](store Store[V], capacity int) *Cache[V] {
+	if capacity <= 0 {
+		capacity = DefaultCacheSize
+	}
+
+	return &Cache[V]{
+		store:    store,
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *Cache[V]) Get(key string) (V, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.get(key)
+}
+
+func (c *Cache[V]) get(key string) (V, bool, error) {
+	if element, ok := c.entries[key]; ok {
+		c.stats.Hits++
+		c.order.MoveToFront(element)
+		return element.Value.(*cacheEntry[V]).value, true, nil
+	}
+
+	c.stats.Misses++
+
+	value, ok, err := c.store.Get(key)
+	if err != nil || !ok {
+		return value, ok, err
+	}
+
+	c.set(key, value)
+	return value, true, nil
+}
+
+func (c *Cache[V]) set(key string, value V) {
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry[V]).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: value})
+
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache[V]) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry[V]).key)
+}
+
+func (c *Cache[V]) Put(key string, value V) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.put(key, value)
+}
+
+func (c *Cache[V]) put(key string, value V) error {
+	err := c.store.Put(key, value)
+	if err != nil {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+		return err
+	}
+
+	c.set(key, value)
+	return nil
+}
+
+func (c *Cache[V]) Update(key string, update func(value V, ok bool) V) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, ok, err := c.get(key)
+	if err != nil {
+		return err
+	}
+
+	return c.put(key, update(value, ok))
+}
+
+func (c *Cache[V]) Delete(key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	return c.store.Delete(key)
+}
+
+func (c *Cache[V]) Iterate(fn func(key string, value V) error) error {
+	return c.store.Iterate(fn)
+}
+
+// Locate returns the file of key in the wrapped store, or "" if the store does
+// not keep keys in known files.
+func (c *Cache[V]) Locate(key string) string {
+	if locator, ok := c.store.(Locator); ok {
+		return locator.Locate(key)
+	}
+	return ""
+}
+
+// Stats returns the cache counters.
+func (c *Cache[V]) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Len = c.order.Len()
+	return stats
+}
+
+func (c *Cache[V]) Sync() error {
+	return c.store.Sync()
+}
+
+func (c *Cache[V]) Close() error {
+	return c.store.Close()
+}
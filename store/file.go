@@ -0,0 +1,289 @@
+package store
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/LucasAlda/demo-falopa/crash"
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+const (
+	filePut    = "P"
+	fileDelete = "D"
+)
+
+// File is a Store kept in a single append-only CSV file. Every write appends
+// a `P,key,value...` or `D,key` row and the whole map is loaded in memory on
+// open. The file is compacted once it holds twice as many rows as live keys.
+type File[V any] struct {
+	mutex    sync.Mutex
+	path     string
+	codec    Codec[V]
+	files    *durability.Files
+	file     *os.File
+	writer   *csv.Writer
+	values   map[string]V
+	rows     int
+	readOnly bool
+	closed   bool
+}
+
+func NewFile[V any](path string, codec Codec[V], options Options) (*File[V], error) {
+	f := &File[V]{path: path, codec: codec, files: durability.NewFiles(options.Durability), values: make(map[string]V), readOnly: options.ReadOnly}
+
+	err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if f.readOnly {
+		return f, nil
+	}
+
+	err = f.openAppend()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *File[V]) load() error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// A crash in the middle of an append leaves a last row without its
+	// newline, everything after the last complete row is dropped. A read
+	// only store ignores it and leaves the file as is.
+	valid := bytes.LastIndexByte(data, '\n') + 1
+	if valid < len(data) && f.readOnly {
+		log.Printf("Ignoring torn tail of %s at offset %d", f.path, valid)
+	} else if valid < len(data) {
+		log.Printf("Discarding torn tail of %s at offset %d", f.path, valid)
+		err = os.Truncate(f.path, int64(valid))
+		if err != nil {
+			return err
+		}
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data[:valid]))
+	reader.FieldsPerRecord = -1
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", f.path, err)
+		}
+
+		if !f.apply(record) {
+			return fmt.Errorf("invalid row in %s: %v", f.path, record)
+		}
+
+		f.rows++
+	}
+
+	return nil
+}
+
+func (f *File[V]) apply(record []string) bool {
+	if len(record) < 2 {
+		return false
+	}
+
+	switch record[0] {
+	case filePut:
+		value, err := f.codec.Decode(record[2:])
+		if err != nil {
+			return false
+		}
+		f.values[record[1]] = value
+	case fileDelete:
+		delete(f.values, record[1])
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (f *File[V]) openAppend() error {
+	_, err := os.Stat(f.path)
+	created := errors.Is(err, os.ErrNotExist)
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		if err := f.files.Created(f.path); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	f.file = file
+	f.writer = csv.NewWriter(file)
+	return nil
+}
+
+func (f *File[V]) append(record []string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+
+	f.writer.Write(record)
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
+		return err
+	}
+
+	crash.Point(crash.StoreAppend)
+
+	if err := f.files.Appended(f.file); err != nil {
+		return err
+	}
+
+	f.rows++
+	return nil
+}
+
+// maybeCompact compacts the file once it holds too many dead rows. It must
+// run after the map has the write just appended, or the compacted file would
+// lose it.
+func (f *File[V]) maybeCompact() error {
+	if f.rows > 2*len(f.values)+1000 {
+		return f.compact()
+	}
+	return nil
+}
+
+func (f *File[V]) compact() error {
+	err := f.files.WriteAtomic(f.path, func(file *os.File) error {
+		writer := csv.NewWriter(file)
+		for key, value := range f.values {
+			writer.Write(append([]string{filePut, key}, f.codec.Encode(value)...))
+		}
+		writer.Flush()
+		return writer.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	f.file.Close()
+	f.rows = len(f.values)
+	return f.openAppend()
+}
+
+func (f *File[V]) Get(key string) (V, bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	value, ok := f.values[key]
+	return value, ok, nil
+}
+
+func (f *File[V]) Put(key string, value V) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.put(key, value)
+}
+
+func (f *File[V]) put(key string, value V) error {
+	err := f.append(append([]string{filePut, key}, f.codec.Encode(value)...))
+	if err != nil {
+		return err
+	}
+
+	f.values[key] = value
+	return f.maybeCompact()
+}
+
+func (f *File[V]) Update(key string, update func(value V, ok bool) V) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	value, ok := f.values[key]
+	return f.put(key, update(value, ok))
+}
+
+func (f *File[V]) Delete(key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.values[key]; !ok {
+		return nil
+	}
+
+	err := f.append([]string{fileDelete, key})
+	if err != nil {
+		return err
+	}
+
+	delete(f.values, key)
+	return f.maybeCompact()
+}
+
+func (f *File[V]) Iterate(fn func(key string, value V) error) error {
+	f.mutex.Lock()
+	keys := make([]string, 0, len(f.values))
+	snapshot := make(map[string]V, len(f.values))
+	for key, value := range f.values {
+		keys = append(keys, key)
+		snapshot[key] = value
+	}
+	f.mutex.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, snapshot[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *File[V]) Locate(key string) string {
+	return f.path
+}
+
+func (f *File[V]) Sync() error {
+	return f.files.Sync()
+}
+
+func (f *File[V]) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return errors.New("store already closed")
+	}
+	f.closed = true
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
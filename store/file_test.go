@@ -0,0 +1,80 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(value string) []string { return []string{value} }
+
+func (stringCodec) Decode(record []string) (string, error) { return record[0], nil }
+
+func reopen(t *testing.T, f *File[string], path string) *File[string] {
+	t.Helper()
+
+	err := f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = NewFile[string](path, stringCodec{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// The write that triggers a compaction must be part of the compacted file.
+func TestFileCompactionKeepsTriggeringWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.csv")
+	f, err := NewFile[string](path, stringCodec{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 1002 {
+		if err := f.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Put("new", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	f = reopen(t, f, path)
+	defer f.Close()
+
+	if value, ok, _ := f.Get("new"); !ok || value != "x" {
+		t.Fatalf("new = %q, %v after reopen, want x", value, ok)
+	}
+}
+
+// A delete that triggers a compaction must not write the key back.
+func TestFileCompactionKeepsTriggeringDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.csv")
+	f, err := NewFile[string](path, stringCodec{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Put("gone", "x"); err != nil {
+		t.Fatal(err)
+	}
+	for range 1001 {
+		if err := f.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	f = reopen(t, f, path)
+	defer f.Close()
+
+	if _, ok, _ := f.Get("gone"); ok {
+		t.Fatal("deleted key is back after reopen")
+	}
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+// Files is a Store that keeps one CSV file per key, `<path>/<key>.csv`, with
+// a single `key,value...` row. It is the layout the worker used before the
+// hashmap and is kept to read old databases.
+type Files[V any] struct {
+	path     string
+	codec    Codec[V]
+	files    *durability.Files
+	readOnly bool
+}
+
+func NewFiles[V any](path string, codec Codec[V], options Options) (*Files[V], error) {
+	if !options.ReadOnly {
+		err := os.MkdirAll(path, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Files[V]{path: path, codec: codec, files: durability.NewFiles(options.Durability), readOnly: options.ReadOnly}, nil
+}
+
+func (f *Files[V]) keyPath(key string) string {
+	return filepath.Join(f.path, key+".csv")
+}
+
+func (f *Files[V]) Get(key string) (V, bool, error) {
+	return f.read(f.keyPath(key))
+}
+
+func (f *Files[V]) read(path string) (V, bool, error) {
+	var value V
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return value, false, nil
+	}
+	if err != nil {
+		return value, false, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	record, err := reader.Read()
+	if err != nil {
+		return value, false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	value, err = f.codec.Decode(record[1:])
+	if err != nil {
+		return value, false, err
+	}
+
+	return value, true, nil
+}
+
+func (f *Files[V]) Put(key string, value V) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+
+	return f.files.WriteAtomic(f.keyPath(key), func(file *os.File) error {
+		writer := csv.NewWriter(file)
+		writer.Write(append([]string{key}, f.codec.Encode(value)...))
+		writer.Flush()
+		return writer.Error()
+	})
+}
+
+func (f *Files[V]) Update(key string, update func(value V, ok bool) V) error {
+	value, ok, err := f.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return f.Put(key, update(value, ok))
+}
+
+func (f *Files[V]) Delete(key string) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+
+	return f.files.Remove(f.keyPath(key))
+}
+
+func (f *Files[V]) Iterate(fn func(key string, value V) error) error {
+	entries, err := os.ReadDir(f.path)
+	if f.readOnly && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".csv") {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(entry.Name(), ".csv"))
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, ok, err := f.Get(key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *Files[V]) Locate(key string) string {
+	return f.keyPath(key)
+}
+
+func (f *Files[V]) Sync() error {
+	return f.files.Sync()
+}
+
+func (f *Files[V]) Close() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/LucasAlda/demo-falopa/hashmap"
+)
+
+// HashMap is a Store backed by the bucketed on-disk hashmap.
+type HashMap[V any] struct {
+	hashmap *hashmap.HashMap
+	codec   Codec[V]
+}
+
+func NewHashMap[V any](path string, buckets int, codec Codec[V], options Options) (*HashMap[V], error) {
+	h, err := hashmap.Open(path, buckets, hashmap.Options{Durability: options.Durability, ReadOnly: options.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashMap[V]{hashmap: h, codec: codec}, nil
+}
+
+func (h *HashMap[V]) Get(key string) (V, bool, error) {
+	var value V
+
+	record, ok, err := h.hashmap.Get(key)
+	if err != nil || !ok {
+		return value, false, err
+	}
+
+	value, err = h.codec.Decode(record)
+	if err != nil {
+		return value, false, err
+	}
+
+	return value, true, nil
+}
+
+func (h *HashMap[V]) Put(key string, value V) error {
+	return readOnlyErr(h.hashmap.Put(key, h.codec.Encode(value)))
+}
+
+func (h *HashMap[V]) Update(key string, update func(value V, ok bool) V) error {
+	var decodeErr error
+
+	err := h.hashmap.Update(key, func(record []string, ok bool) []string {
+		var value V
+		if ok {
+			value, decodeErr = h.codec.Decode(record)
+			if decodeErr != nil {
+				// an empty value fails the update before anything is
+				// written
+				return nil
+			}
+		}
+
+		return h.codec.Encode(update(value, ok))
+	})
+
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	return readOnlyErr(err)
+}
+
+func (h *HashMap[V]) Delete(key string) error {
+	return readOnlyErr(h.hashmap.Delete(key))
+}
+
+// readOnlyErr reports the writes refused by a read only hashmap as
+// ErrReadOnly, like the other backends.
+func readOnlyErr(err error) error {
+	if errors.Is(err, hashmap.ErrReadOnly) {
+		return ErrReadOnly
+	}
+	return err
+}
+
+func (h *HashMap[V]) Iterate(fn func(key string, value V) error) error {
+	return h.hashmap.Iterate(func(key string, record []string) error {
+		value, err := h.codec.Decode(record)
+		if err != nil {
+			return err
+		}
+
+		return fn(key, value)
+	})
+}
+
+func (h *HashMap[V]) Locate(key string) string {
+	return h.hashmap.BucketPath(key)
+}
+
+func (h *HashMap[V]) Sync() error {
+	return h.hashmap.Sync()
+}
+
+func (h *HashMap[V]) Close() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// Memory is a Store that lives only in memory. Nothing survives a restart, so
+// it is meant for tests and for running the worker without a volume.
+type Memory[V any] struct {
+	mutex  sync.Mutex
+	values map[string]V
+}
+
+func NewMemory[V any]() *Memory[V] {
+	return &Memory[V]{values: make(map[string]V)}
+}
+
+func (m *Memory[V]) Get(key string) (V, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	value, ok := m.values[key]
+	return value, ok, nil
+}
+
+func (m *Memory[V]) Put(key string, value V) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.values[key] = value
+	return nil
+}
+
+func (m *Memory[V]) Update(key string, update func(value V, ok bool) V) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	value, ok := m.values[key]
+	m.values[key] = update(value, ok)
+	return nil
+}
+
+func (m *Memory[V]) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.values, key)
+	return nil
+}
+
+// Iterate walks the keys in sorted order over a snapshot of the store, so fn
+// may write to it.
+func (m *Memory[V]) Iterate(fn func(key string, value V) error) error {
+	m.mutex.Lock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	snapshot := make(map[string]V, len(m.values))
+	for key, value := range m.values {
+		snapshot[key] = value
+	}
+	m.mutex.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, snapshot[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory[V]) Sync() error {
+	return nil
+}
+
+func (m *Memory[V]) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+// Store is a typed key/value store. Every backend keeps string keys and uses
+// a Codec to turn values into CSV records when it needs to persist them.
+type Store[V any] interface {
+	Get(key string) (V, bool, error)
+	Put(key string, value V) error
+	Update(key string, update func(value V, ok bool) V) error
+	Delete(key string) error
+	Iterate(fn func(key string, value V) error) error
+	// Sync makes every write done so far durable.
+	Sync() error
+	Close() error
+}
+
+// Locator is implemented by the backends that keep each key in a known file.
+// Locate returns the path of the file holding key.
+type Locator interface {
+	Locate(key string) string
+}
+
+// Codec converts values to and from the CSV record written to disk. The key
+// is never part of the record, backends store it on their own.
+type Codec[V any] interface {
+	Encode(value V) []string
+	Decode(record []string) (V, error)
+}
+
+const (
+	BackendHashMap = "hashmap"
+	BackendFiles   = "files"
+	BackendFile    = "file"
+	BackendMemory  = "memory"
+)
+
+const defaultBuckets = 1024
+
+var ErrReadOnly = errors.New("store opened read only")
+
+type Options struct {
+	// Durability says how writes are synced.
+	Durability durability.Level
+	// ReadOnly opens the store without changing it, for inspection: nothing
+	// is created or repaired, a missing store reads as empty, and every
+	// write fails with ErrReadOnly. The memory backend ignores it.
+	ReadOnly bool
+	// Buckets is how many buckets a new hashmap store spreads its keys
+	// over, 1024 by default. An existing one keeps its own.
+	Buckets int
+}
+
+// Open opens a store of the given backend rooted at path. An empty backend
+// opens the hashmap backend.
+func Open[V any](backend string, path string, codec Codec[V], options Options) (Store[V], error) {
+	switch backend {
+	case BackendHashMap, "":
+		buckets := options.Buckets
+		if buckets <= 0 {
+			buckets = defaultBuckets
+		}
+		return NewHashMap(path, buckets, codec, options)
+	case BackendFiles:
+		return NewFiles(path, codec, options)
+	case BackendFile:
+		if !options.ReadOnly {
+			err := os.MkdirAll(path, 0777)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewFile(filepath.Join(path, "store.csv"), codec, options)
+	case BackendMemory:
+		return NewMemory[V](), nil
+	}
+
+	return nil, fmt.Errorf("unknown store backend: %s", backend)
+}
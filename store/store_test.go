@@ -0,0 +1,111 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// A read only store of any disk backend creates nothing, reads a missing
+// store as empty and refuses every write.
+func TestReadOnlyChangesNothing(t *testing.T) {
+	for _, backend := range []string{BackendHashMap, BackendFiles, BackendFile} {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "stats")
+
+			s, err := Open[string](backend, path, stringCodec{}, Options{ReadOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("read only open created %s: %v", path, err)
+			}
+
+			if _, ok, err := s.Get("k"); ok || err != nil {
+				t.Fatalf("Get on a missing store = %v, %v", ok, err)
+			}
+			if err := s.Iterate(func(string, string) error { return errors.New("a key") }); err != nil {
+				t.Fatalf("Iterate on a missing store = %v", err)
+			}
+
+			if err := s.Put("k", "v"); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("Put = %v, want ErrReadOnly", err)
+			}
+			if err := s.Update("k", func(string, bool) string { return "v" }); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("Update = %v, want ErrReadOnly", err)
+			}
+		})
+	}
+}
+
+// A read only File store leaves a torn tail in place.
+func TestReadOnlyFileKeepsTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.csv")
+	data := "P,k,v\nP,torn"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFile[string](path, stringCodec{}, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if value, ok, _ := f.Get("k"); !ok || value != "v" {
+		t.Fatalf("k = %q, %v, want v", value, ok)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil || string(written) != data {
+		t.Fatalf("file = %q, %v, want it untouched", written, err)
+	}
+}
+
+type intCodec struct{}
+
+func (intCodec) Encode(value int) []string { return []string{strconv.Itoa(value)} }
+
+func (intCodec) Decode(record []string) (int, error) { return strconv.Atoi(record[0]) }
+
+// An Update of a record that does not decode fails without writing anything.
+func TestHashMapUpdateDecodeError(t *testing.T) {
+	path := t.TempDir()
+
+	raw, err := NewHashMap[string](path, 1, stringCodec{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Put("k", "not a number"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(raw.Locate("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	h, err := NewHashMap[int](path, 1, intCodec{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	called := false
+	err = h.Update("k", func(value int, ok bool) int {
+		called = true
+		return value + 1
+	})
+	if err == nil || called {
+		t.Fatalf("Update = %v, called %v, want a decode error", err, called)
+	}
+
+	after, err := os.ReadFile(h.Locate("k"))
+	if err != nil || string(after) != string(before) {
+		t.Fatalf("bucket = %q, %v, want it untouched", after, err)
+	}
+}
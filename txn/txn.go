@@ -0,0 +1,338 @@
+package txn
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+
+	"github.com/LucasAlda/demo-falopa/crash"
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/store"
+	"github.com/LucasAlda/demo-falopa/wal"
+)
+
+// A transaction is written to the WAL as a CSV payload, one row per staged
+// operation, in the order they were staged:
+//
+//	W,key,value...
+//	D,key
+//	M,name,value
+const (
+	opWrite  = "W"
+	opDelete = "D"
+	opMeta   = "M"
+)
+
+// checkpointInterval is how many transactions are applied between two
+// checkpoints at the durability.Commit level.
+const checkpointInterval = 1024
+
+// Meta applies the metadata entries of transactions, after their writes. It
+// must be idempotent since recovery may apply a transaction again, and Sync
+// must make every entry applied so far durable.
+type Meta interface {
+	ApplyMeta(name string, value string) error
+	Sync() error
+}
+
+// Manager runs transactions over a store. Every transaction is written to the
+// WAL as a single record before any of its writes reach the store, so after a
+// crash the whole transaction is rolled forward or none of it is.
+//
+// At the durability.Commit level the store is not synced on every write, so
+// transactions are only marked applied in the WAL by the checkpoint that
+// syncs the store. Until then a power loss replays them.
+type Manager[V any] struct {
+	commits   *wal.WAL
+	store     store.Store[V]
+	codec     store.Codec[V]
+	meta      Meta
+	unapplied []uint64
+}
+
+// NewManager returns a Manager applying transactions to s, and their
+// metadata to meta, which may be nil.
+func NewManager[V any](commits *wal.WAL, s store.Store[V], codec store.Codec[V], meta Meta) *Manager[V] {
+	return &Manager[V]{commits: commits, store: s, codec: codec, meta: meta}
+}
+
+// Recovery reports what Recover did.
+type Recovery struct {
+	// Transactions is how many transactions were rolled forward.
+	Transactions int
+	// Keys are the keys written or deleted by them.
+	Keys map[string]bool
+}
+
+// Recover rolls forward every transaction that was committed to the WAL but
+// not fully applied.
+func (m *Manager[V]) Recover() (Recovery, error) {
+	recovery := Recovery{Keys: make(map[string]bool)}
+
+	err := m.commits.Replay(func(seq uint64, payload []byte) error {
+		ops, err := decode(payload)
+		if err != nil {
+			return fmt.Errorf("failed to decode transaction %d: %w", seq, err)
+		}
+
+		recovery.Transactions++
+		for _, op := range ops {
+			if op[0] != opMeta {
+				recovery.Keys[op[1]] = true
+			}
+		}
+
+		err = m.apply(ops)
+		if err != nil {
+			return err
+		}
+
+		return m.applied(seq)
+	})
+	if err != nil {
+		return recovery, err
+	}
+
+	return recovery, m.Checkpoint()
+}
+
+// Inspect calls fn with the operations of every transaction left in the WAL,
+// without applying them. ops are rows as described at the top of this file.
+func (m *Manager[V]) Inspect(fn func(seq uint64, ops [][]string) error) error {
+	return m.commits.Replay(func(seq uint64, payload []byte) error {
+		ops, err := decode(payload)
+		if err != nil {
+			return fmt.Errorf("failed to decode transaction %d: %w", seq, err)
+		}
+
+		return fn(seq, ops)
+	})
+}
+
+// MetaValue returns the value of the metadata entry name among ops, as given
+// to Inspect.
+func MetaValue(ops [][]string, name string) (string, bool) {
+	for _, op := range ops {
+		if op[0] == opMeta && len(op) == 3 && op[1] == name {
+			return op[2], true
+		}
+	}
+	return "", false
+}
+
+// Discard marks every transaction left in the WAL as applied without applying
+// it, and returns how many there were.
+func (m *Manager[V]) Discard() (int, error) {
+	discarded := 0
+
+	err := m.commits.Replay(func(seq uint64, payload []byte) error {
+		discarded++
+		return m.commits.Applied(seq)
+	})
+
+	return discarded, err
+}
+
+func (m *Manager[V]) applied(seq uint64) error {
+	if m.commits.Durability() != durability.Commit {
+		return m.commits.Applied(seq)
+	}
+
+	m.unapplied = append(m.unapplied, seq)
+	if len(m.unapplied) >= checkpointInterval {
+		return m.Checkpoint()
+	}
+
+	return nil
+}
+
+// Checkpoint syncs the store and the metadata, and marks every transaction
+// applied since the last checkpoint as applied in the WAL.
+func (m *Manager[V]) Checkpoint() error {
+	if len(m.unapplied) == 0 {
+		return nil
+	}
+
+	err := m.store.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync store: %w", err)
+	}
+
+	if m.meta != nil {
+		err = m.meta.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync metadata: %w", err)
+		}
+	}
+
+	for _, seq := range m.unapplied {
+		if err := m.commits.Applied(seq); err != nil {
+			return err
+		}
+	}
+
+	m.unapplied = nil
+	return nil
+}
+
+func (m *Manager[V]) Begin() *Tx[V] {
+	return &Tx[V]{manager: m, staged: make(map[string]int)}
+}
+
+func (m *Manager[V]) apply(ops [][]string) error {
+	for _, op := range ops {
+		var err error
+
+		switch op[0] {
+		case opWrite:
+			var value V
+			value, err = m.codec.Decode(op[2:])
+			if err == nil {
+				err = m.store.Put(op[1], value)
+			}
+		case opDelete:
+			err = m.store.Delete(op[1])
+		case opMeta:
+			if m.meta != nil {
+				err = m.meta.ApplyMeta(op[1], op[2])
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tx stages writes to any number of keys plus metadata. Nothing is visible in
+// the store until Commit.
+type Tx[V any] struct {
+	manager *Manager[V]
+	ops     [][]string
+	staged  map[string]int
+	values  map[string]V
+	done    bool
+}
+
+// Get returns the value of key as seen by the transaction, including its own
+// staged writes.
+func (tx *Tx[V]) Get(key string) (V, bool, error) {
+	if _, ok := tx.staged[key]; ok {
+		value, ok := tx.values[key]
+		return value, ok, nil
+	}
+
+	return tx.manager.store.Get(key)
+}
+
+func (tx *Tx[V]) Put(key string, value V) {
+	if tx.values == nil {
+		tx.values = make(map[string]V)
+	}
+
+	tx.stage(key, append([]string{opWrite, key}, tx.manager.codec.Encode(value)...))
+	tx.values[key] = value
+}
+
+func (tx *Tx[V]) Update(key string, update func(value V, ok bool) V) error {
+	value, ok, err := tx.Get(key)
+	if err != nil {
+		return err
+	}
+
+	tx.Put(key, update(value, ok))
+	return nil
+}
+
+func (tx *Tx[V]) Delete(key string) {
+	tx.stage(key, []string{opDelete, key})
+	delete(tx.values, key)
+}
+
+// SetMeta stages a metadata entry, such as the id of the message the
+// transaction processes.
+func (tx *Tx[V]) SetMeta(name string, value string) {
+	tx.ops = append(tx.ops, []string{opMeta, name, value})
+}
+
+// stage keeps only the last operation on each key.
+func (tx *Tx[V]) stage(key string, op []string) {
+	if index, ok := tx.staged[key]; ok {
+		tx.ops[index] = op
+		return
+	}
+
+	tx.staged[key] = len(tx.ops)
+	tx.ops = append(tx.ops, op)
+}
+
+// Commit writes the transaction to the WAL and applies it. Once the WAL
+// record is written the transaction is durable: if applying it fails, it is
+// rolled forward by the next Recover.
+func (tx *Tx[V]) Commit() error {
+	if tx.done {
+		return fmt.Errorf("transaction already committed")
+	}
+	tx.done = true
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	seq, err := tx.manager.commits.Append(encode(tx.ops))
+	if err != nil {
+		return fmt.Errorf("failed to write transaction: %w", err)
+	}
+
+	crash.Point(crash.CommitWrite)
+
+	err = tx.manager.apply(tx.ops)
+	if err != nil {
+		return fmt.Errorf("failed to apply transaction %d: %w", seq, err)
+	}
+
+	err = tx.manager.applied(seq)
+	if err != nil {
+		return err
+	}
+
+	crash.Point(crash.CommitEnd)
+	return nil
+}
+
+func encode(ops [][]string) []byte {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.WriteAll(ops)
+	return buffer.Bytes()
+}
+
+func decode(payload []byte) ([][]string, error) {
+	reader := csv.NewReader(bytes.NewReader(payload))
+	reader.FieldsPerRecord = -1
+
+	ops, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		valid := false
+		switch op[0] {
+		case opWrite:
+			valid = len(op) >= 2
+		case opDelete:
+			valid = len(op) == 2
+		case opMeta:
+			valid = len(op) == 3
+		}
+
+		if !valid {
+			return nil, fmt.Errorf("invalid operation: %v", op)
+		}
+	}
+
+	return ops, nil
+}
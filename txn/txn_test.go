@@ -0,0 +1,144 @@
+package txn
+
+import (
+	"testing"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+	"github.com/LucasAlda/demo-falopa/store"
+	"github.com/LucasAlda/demo-falopa/wal"
+)
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(value string) []string { return []string{value} }
+
+func (stringCodec) Decode(record []string) (string, error) { return record[0], nil }
+
+// syncCounter counts the syncs of the store under it.
+type syncCounter struct {
+	store.Store[string]
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return s.Store.Sync()
+}
+
+// At the Commit level a transaction is only marked applied by the checkpoint
+// that syncs the store, so until then reopening the WAL replays it. At None
+// and Full it is marked applied as soon as it is.
+func TestAppliedAtCheckpoint(t *testing.T) {
+	tests := []struct {
+		level durability.Level
+		// replayed says whether the commit is left to replay before the
+		// checkpoint.
+		replayed bool
+	}{
+		{durability.None, false},
+		{durability.Commit, true},
+		{durability.Full, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.level.String(), func(t *testing.T) {
+			path := t.TempDir()
+			options := wal.Options{Durability: test.level}
+
+			commits, err := wal.Open(path, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer commits.Close()
+
+			s := &syncCounter{Store: store.NewMemory[string]()}
+			manager := NewManager[string](commits, s, stringCodec{}, nil)
+
+			tx := manager.Begin()
+			tx.Put("k", "v")
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if value, ok, _ := s.Get("k"); !ok || value != "v" {
+				t.Fatalf("store holds %q, %v after commit", value, ok)
+			}
+
+			replayed := func() int {
+				t.Helper()
+
+				reopened, err := wal.Open(path, wal.Options{Durability: test.level, ReadOnly: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer reopened.Close()
+				return reopened.Pending()
+			}
+
+			want := 0
+			if test.replayed {
+				want = 1
+			}
+			if got := replayed(); got != want {
+				t.Errorf("commits to replay before the checkpoint = %d, want %d", got, want)
+			}
+
+			if err := manager.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			if test.replayed && s.syncs != 1 {
+				t.Errorf("store synced %d times by the checkpoint, want 1", s.syncs)
+			}
+			if got := replayed(); got != 0 {
+				t.Errorf("commits to replay after the checkpoint = %d, want 0", got)
+			}
+		})
+	}
+}
+
+// Recover rolls forward a transaction left in the WAL by a crash before it
+// was applied.
+func TestRecoverRollsForward(t *testing.T) {
+	path := t.TempDir()
+	options := wal.Options{Durability: durability.Full}
+
+	commits, err := wal.Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commits.Append(encode([][]string{{opWrite, "k", "v"}, {opDelete, "gone"}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := commits.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	commits, err = wal.Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer commits.Close()
+
+	s := store.NewMemory[string]()
+	if err := s.Put("gone", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	recovery, err := NewManager[string](commits, s, stringCodec{}, nil).Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovery.Transactions != 1 || !recovery.Keys["k"] || !recovery.Keys["gone"] {
+		t.Errorf("recovery = %+v, want one transaction over k and gone", recovery)
+	}
+
+	if value, ok, _ := s.Get("k"); !ok || value != "v" {
+		t.Errorf("k = %q, %v after recover, want v", value, ok)
+	}
+	if _, ok, _ := s.Get("gone"); ok {
+		t.Error("gone still present after recover")
+	}
+	if commits.Pending() != 0 {
+		t.Errorf("%d commits pending after recover", commits.Pending())
+	}
+}
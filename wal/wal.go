@@ -0,0 +1,498 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LucasAlda/demo-falopa/durability"
+)
+
+// Every record is framed as:
+//
+//	length  uint32  bytes after the checksum
+//	crc     uint32  castagnoli checksum of everything after it
+//	seq     uint64
+//	kind    uint8
+//	payload []byte
+//
+// A commit record carries the caller's payload, an applied record carries
+// the 8 byte sequence number of the commit it marks as applied.
+const headerSize = 8
+const bodyHeaderSize = 9
+
+const (
+	kindCommit  byte = 1
+	kindApplied byte = 2
+)
+
+const segmentSuffix = ".wal"
+
+const DefaultSegmentSize = 4 * 1024 * 1024
+
+type Options struct {
+	// SegmentSize is the size after which a new segment is started.
+	SegmentSize int64
+	// Durability says which records are fsynced: commit records from
+	// durability.Commit on, applied markers only at durability.Full.
+	Durability durability.Level
+	// ReadOnly opens the log without changing it: a torn tail is reported
+	// by Torn instead of truncated, and nothing can be appended.
+	ReadOnly bool
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorrupted = errors.New("wal corrupted")
+
+var ErrReadOnly = errors.New("wal opened read only")
+
+type segment struct {
+	first   uint64
+	path    string
+	pending int
+}
+
+type pendingRecord struct {
+	seq     uint64
+	segment *segment
+	payload []byte
+}
+
+// WAL is a segmented write-ahead log. Callers Append a commit record before
+// touching their data and mark it Applied once it is done. On restart Replay
+// hands back, in order, every commit that was never marked as applied.
+type WAL struct {
+	mutex     sync.Mutex
+	path      string
+	options   Options
+	segments  []*segment
+	file      *os.File
+	size      int64
+	nextSeq   uint64
+	pending   map[uint64]*pendingRecord
+	recovered []*pendingRecord
+	torn      error
+	// failed is set once a partial write could not be undone, every later
+	// write fails with it.
+	failed error
+}
+
+// Open opens the log stored in path, creating it if needed. A torn record at
+// the end of the last segment, left by a crash in the middle of a write, is
+// truncated away.
+func Open(path string, options Options) (*WAL, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+
+	if !options.ReadOnly {
+		err := os.MkdirAll(path, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w := &WAL{path: path, options: options, nextSeq: 1, pending: make(map[uint64]*pendingRecord)}
+
+	firsts, err := listSegments(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, first := range firsts {
+		seg := &segment{first: first, path: w.segmentPath(first)}
+		w.segments = append(w.segments, seg)
+
+		// an empty segment still holds the sequences from its name up, a
+		// crash right after a rotation leaves no record to move past them
+		w.nextSeq = max(w.nextSeq, first)
+
+		err := w.load(seg, i == len(firsts)-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.ReadOnly {
+		return w, nil
+	}
+
+	if len(w.segments) == 0 {
+		err = w.rotate()
+	} else {
+		err = w.openLast()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func listSegments(path string) ([]uint64, error) {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var firsts []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		firsts = append(firsts, first)
+	}
+
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+	return firsts, nil
+}
+
+func (w *WAL) segmentPath(first uint64) string {
+	return filepath.Join(w.path, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
+
+func (w *WAL) load(seg *segment, last bool) error {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		seq, kind, payload, size, err := readRecord(reader, info.Size()-offset)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			if !last {
+				return fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupted, seg.path, offset, err)
+			}
+
+			w.torn = fmt.Errorf("torn tail of %s at offset %d: %v", seg.path, offset, err)
+			if w.options.ReadOnly {
+				return nil
+			}
+
+			log.Printf("Truncating %v", w.torn)
+			return os.Truncate(seg.path, offset)
+		}
+
+		offset += size
+		w.nextSeq = seq + 1
+
+		switch kind {
+		case kindCommit:
+			record := &pendingRecord{seq: seq, segment: seg, payload: payload}
+			w.pending[seq] = record
+			w.recovered = append(w.recovered, record)
+			seg.pending++
+		case kindApplied:
+			w.markApplied(binary.BigEndian.Uint64(payload))
+		}
+	}
+}
+
+// readRecord reads the next record out of the remaining bytes of a segment.
+// A length past them is taken as a torn header, before allocating it.
+func readRecord(reader io.Reader, remaining int64) (uint64, byte, []byte, int64, error) {
+	var header [headerSize]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err == io.EOF {
+		return 0, 0, nil, 0, io.EOF
+	}
+	if err != nil {
+		return 0, 0, nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	if length < bodyHeaderSize {
+		return 0, 0, nil, 0, fmt.Errorf("invalid record length %d", length)
+	}
+	if int64(length) > remaining-headerSize {
+		return 0, 0, nil, 0, fmt.Errorf("record length %d past the end of the segment", length)
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return 0, 0, nil, 0, err
+	}
+
+	if crc32.Checksum(body, crcTable) != checksum {
+		return 0, 0, nil, 0, errors.New("checksum mismatch")
+	}
+
+	seq := binary.BigEndian.Uint64(body[0:8])
+	return seq, body[8], body[bodyHeaderSize:], int64(headerSize + length), nil
+}
+
+func encodeRecord(seq uint64, kind byte, payload []byte) []byte {
+	record := make([]byte, headerSize+bodyHeaderSize+len(payload))
+	body := record[headerSize:]
+
+	binary.BigEndian.PutUint64(body[0:8], seq)
+	body[8] = kind
+	copy(body[bodyHeaderSize:], payload)
+
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(body, crcTable))
+	return record
+}
+
+func (w *WAL) openLast() error {
+	seg := w.segments[len(w.segments)-1]
+
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *WAL) rotate() error {
+	if w.file != nil {
+		if err := w.sync(durability.Commit); err != nil {
+			return err
+		}
+
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	seg := &segment{first: w.nextSeq, path: w.segmentPath(w.nextSeq)}
+
+	// a segment is never reopened as a new one, removeApplied would unlink
+	// it while it is written
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+
+	w.segments = append(w.segments, seg)
+	w.file = file
+	w.size = 0
+
+	if w.options.Durability >= durability.Commit {
+		if err := durability.SyncDir(w.path); err != nil {
+			return err
+		}
+	}
+
+	w.removeApplied()
+	return nil
+}
+
+// sync fsyncs the current segment if the durability level is at least level.
+func (w *WAL) sync(level durability.Level) error {
+	if w.options.Durability < level {
+		return nil
+	}
+
+	return w.file.Sync()
+}
+
+// removeApplied deletes the oldest segments as long as all their commits are
+// applied. Segments are only removed in order, so an applied marker is never
+// lost while the commit it refers to is still on disk.
+func (w *WAL) removeApplied() {
+	for len(w.segments) > 1 && w.segments[0].pending == 0 {
+		err := os.Remove(w.segments[0].path)
+		if err != nil {
+			log.Printf("failed to remove wal segment: %v", err)
+			return
+		}
+		w.segments = w.segments[1:]
+	}
+}
+
+func (w *WAL) write(kind byte, payload []byte) (uint64, error) {
+	if w.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if w.size >= w.options.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.failed != nil {
+		return 0, w.failed
+	}
+
+	seq := w.nextSeq
+	record := encodeRecord(seq, kind, payload)
+
+	_, err := w.file.Write(record)
+	if err != nil {
+		// a partial record would be followed by the next ones, and taken
+		// on open for a torn tail that drops them
+		if truncErr := w.file.Truncate(w.size); truncErr != nil {
+			w.failed = fmt.Errorf("wal failed after a partial write: %w", truncErr)
+		}
+		return 0, err
+	}
+
+	w.nextSeq++
+	w.size += int64(len(record))
+	return seq, nil
+}
+
+// Append writes a commit record with payload and returns its sequence number.
+func (w *WAL) Append(payload []byte) (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	seq, err := w.write(kindCommit, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	err = w.sync(durability.Commit)
+	if err != nil {
+		return 0, err
+	}
+
+	seg := w.segments[len(w.segments)-1]
+	w.pending[seq] = &pendingRecord{seq: seq, segment: seg}
+	seg.pending++
+	return seq, nil
+}
+
+// Applied marks the commit seq as applied, so it is not replayed again.
+func (w *WAL) Applied(seq uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.pending[seq]; !ok {
+		return nil
+	}
+
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], seq)
+
+	_, err := w.write(kindApplied, payload[:])
+	if err != nil {
+		return err
+	}
+
+	err = w.sync(durability.Full)
+	if err != nil {
+		return err
+	}
+
+	w.markApplied(seq)
+	return nil
+}
+
+func (w *WAL) markApplied(seq uint64) {
+	record, ok := w.pending[seq]
+	if !ok {
+		return
+	}
+
+	record.segment.pending--
+	delete(w.pending, seq)
+}
+
+// Replay calls apply, in sequence order, for every commit found on open that
+// was never marked as applied. apply is in charge of marking them applied.
+// Replay stops at the first error so later commits are not applied out of
+// order.
+func (w *WAL) Replay(apply func(seq uint64, payload []byte) error) error {
+	w.mutex.Lock()
+	var records []*pendingRecord
+	for _, record := range w.recovered {
+		if _, ok := w.pending[record.seq]; ok {
+			records = append(records, record)
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, record := range records {
+		if err := apply(record.seq, record.payload); err != nil {
+			return err
+		}
+	}
+
+	w.mutex.Lock()
+	var left []*pendingRecord
+	for _, record := range w.recovered {
+		if _, ok := w.pending[record.seq]; ok {
+			left = append(left, record)
+		}
+	}
+	w.recovered = left
+	w.mutex.Unlock()
+
+	return nil
+}
+
+// Torn returns the torn tail found on open, if any. It was truncated away
+// unless the log is read only.
+func (w *WAL) Torn() error {
+	return w.torn
+}
+
+func (w *WAL) Durability() durability.Level {
+	return w.options.Durability
+}
+
+// Pending returns how many commits are not applied yet.
+func (w *WAL) Pending() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return len(w.pending)
+}
+
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	return w.file.Close()
+}
@@ -0,0 +1,123 @@
+package wal
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+// A torn header whose length runs past the end of the segment is truncated
+// away like any torn tail, without allocating that length.
+func TestTornLengthPastSegment(t *testing.T) {
+	path := t.TempDir()
+
+	w, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Append([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	segment := w.segments[0].path
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[0:4], 0xFFFFFFF0)
+	file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(append(header[:], "garbage"...)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	w, err = Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if w.Torn() == nil {
+		t.Fatal("torn tail not reported")
+	}
+	if w.Pending() != 1 {
+		t.Fatalf("%d commits pending, want 1", w.Pending())
+	}
+
+	truncated, err := os.Stat(segment)
+	if err != nil || truncated.Size() != info.Size() {
+		t.Fatalf("segment size %d after open, want %d: %v", truncated.Size(), info.Size(), err)
+	}
+}
+
+// A crash right after a rotation that removed every other segment leaves an
+// empty segment named above 1. Reopening goes on from its name, so the next
+// rotation never reopens it.
+func TestReopenEmptySegmentKeepsSequence(t *testing.T) {
+	path := t.TempDir()
+
+	w, err := Open(path, Options{SegmentSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		seq, err := w.Append([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Applied(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.write(kindApplied, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	last := w.segments[len(w.segments)-1]
+	if err := w.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	empty := w.segments[len(w.segments)-1]
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the crash lost the removal of the previous segments but the last one
+	for _, seg := range w.segments[:len(w.segments)-1] {
+		os.Remove(seg.path)
+	}
+	if empty.first <= 1 || empty.first <= last.first {
+		t.Fatalf("empty segment named %d", empty.first)
+	}
+
+	w, err = Open(path, Options{SegmentSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for range 2 {
+		seq, err := w.Append([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq < empty.first {
+			t.Fatalf("appended %d below the segment %d", seq, empty.first)
+		}
+	}
+
+	for _, seg := range w.segments {
+		if _, err := os.Stat(seg.path); err != nil {
+			t.Fatalf("segment %d: %v", seg.first, err)
+		}
+	}
+	if w.Pending() != 2 {
+		t.Fatalf("%d commits pending, want 2", w.Pending())
+	}
+}
@@ -1,35 +1,104 @@
 package main
 
 import (
-	"encoding/binary"
-	"encoding/csv"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/LucasAlda/demo-falopa/durability"
 	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/statsdb"
 )
 
 // const demo = "REVIEW"
 
-var statsCache = make(map[int]middleware.Stats)
-
 func main() {
+	// docker stop sends SIGTERM, stop consuming and commit what was processed
+	// so nothing is redelivered
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// the end of stream state lives with the stats, so a restart neither
+	// waits for an end already acked nor commits it twice
+	eofStore, err := middleware.NewFileEOFStore("./database/eof")
+	if err != nil {
+		panic(err)
+	}
+
 	middleware, err := middleware.NewMiddleware()
 	if err != nil {
 		panic(err)
 	}
 	defer middleware.Close()
+	middleware.SetEOFStore(eofStore)
+
+	level, err := durability.ParseLevel(os.Getenv("DURABILITY"))
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("Durability: %v", level)
 
-	os.MkdirAll("./database/stats", 0777)
+	cacheSize, _ := strconv.Atoi(os.Getenv("CACHE_SIZE"))
+
+	// every client gets its own stats and processed ids, deleted once its
+	// results are sent
+	clients, err := statsdb.OpenClients("./database/clients", statsdb.Options{
+		Backend:    os.Getenv("STORE"),
+		Durability: level,
+		CacheSize:  cacheSize,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer clients.Close()
+
+	// the database of the workers that predate the clients holds the
+	// messages without one
+	adopted, err := clients.AdoptLegacy("./database", "eof")
+	if err != nil {
+		log.Fatalf("failed to move the legacy database: %v", err)
+	}
+	if adopted {
+		log.Printf("Moved the legacy database to %s", statsdb.ClientPath("./database/clients", ""))
+	}
+
+	// recover the databases left by a crash now, not on their next message
+	err = recoverClients(clients)
+	if err != nil {
+		log.Fatalf("failed to recover: %v", err)
+	}
+
+	go clients.LogCacheStats(10 * time.Second)
 
 	metrics := make(chan int)
 	go writeMetrics(metrics)
 
-	processStats(middleware, metrics)
+	err = processStats(ctx, middleware, clients, metrics)
+	if err != nil {
+		log.Fatalf("failed to process stats: %v", err)
+	}
+}
+
+// recoverClients opens every client database on disk, which recovers it.
+func recoverClients(clients *statsdb.Clients) error {
+	ids, err := clients.List()
+	if err != nil {
+		return err
+	}
+
+	for _, clientId := range ids {
+		_, err := clients.Get(clientId)
+		if err != nil {
+			return fmt.Errorf("client %q: %w", clientId, err)
+		}
+	}
+
+	return nil
 }
 
 type Game struct {
@@ -69,245 +138,182 @@ func writeMetrics(metrics <-chan int) error {
 	return nil
 }
 
-func updateStat(stat *middleware.Stats, tmpFile *os.File) {
-	if cached, ok := statsCache[stat.AppId]; ok {
-		stat.Negatives += cached.Negatives
-		stat.Positives += cached.Positives
-	} else {
-		file, err := os.Open(fmt.Sprintf("./database/stats/%d.csv", stat.AppId))
-		if err == nil {
-			reader := csv.NewReader(file)
-
-			record, err := reader.Read()
-			if err != nil && err != io.EOF {
-				log.Printf("failed to read line: %v", err)
-				return
-			}
-
-			positives, err := strconv.Atoi(record[2])
-			if err != nil {
-				log.Printf("failed to convert positives to int: %v", err)
-				return
-			}
-
-			negatives, err := strconv.Atoi(record[3])
-			if err != nil {
-				log.Printf("failed to convert negatives to int: %v", err)
-				return
-			}
+const defaultBatchSize = 1
+const defaultBatchTimeout = 10 * time.Millisecond
 
-			stat.Positives += positives
-			stat.Negatives += negatives
-		}
+// statsQuery is the query the stats of the worker answer.
+const statsQuery = 5
 
-		file.Close()
+// batchOptions reads the batch size and timeout from the BATCH_SIZE and
+// BATCH_TIMEOUT_MS env vars. The broker prefetch caps how many unacked
+// messages a worker holds, so batches bigger than it are only flushed by the
+// timeout.
+func batchOptions() (int, time.Duration) {
+	size := defaultBatchSize
+	if value, err := strconv.Atoi(os.Getenv("BATCH_SIZE")); err == nil && value > 0 {
+		size = value
 	}
 
-	writer := csv.NewWriter(tmpFile)
-
-	err := writer.Write([]string{strconv.Itoa(stat.AppId), stat.Name, strconv.Itoa(stat.Positives), strconv.Itoa(stat.Negatives)})
-	if err != nil {
-		log.Printf("failed to write to file: %v", err)
-		return
+	timeout := defaultBatchTimeout
+	if value, err := strconv.Atoi(os.Getenv("BATCH_TIMEOUT_MS")); err == nil && value > 0 {
+		timeout = time.Duration(value) * time.Millisecond
 	}
 
-	writer.Flush()
-	statsCache[stat.AppId] = *stat
+	log.Printf("Group commit: %d messages or %v", size, timeout)
+
+	return size, timeout
 }
 
-func updateProcessed(id int) {
+// worker groups the stats of every client in a batch committing to the
+// database of the client.
+type worker struct {
+	middleware *middleware.Middleware
+	clients    *statsdb.Clients
+	batches    map[string]*statsdb.Batch
+	size       int
+	timeout    time.Duration
+}
 
-	file, err := os.OpenFile("./database/processed.bin", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
-	if err != nil {
-		return
+// batch returns the batch of a client, opening its database the first time.
+func (w *worker) batch(clientId string) (*statsdb.Batch, error) {
+	if batch, ok := w.batches[clientId]; ok {
+		return batch, nil
 	}
 
-	defer file.Close()
-
-	err = binary.Write(file, binary.BigEndian, int32(id))
+	db, err := w.clients.Get(clientId)
 	if err != nil {
-		log.Printf("failed to write to file: %v", err)
-		return
+		return nil, err
 	}
 
+	batch := statsdb.NewBatch(db, w.size, w.timeout)
+	w.batches[clientId] = batch
+	return batch, nil
 }
 
-func getAlreadyProcessed() map[int]bool {
-	alreadyProcessed := make(map[int]bool)
-	file, err := os.Open("./database/processed.bin")
-	if err != nil {
-		return alreadyProcessed
+// process adds the message to the stats of its client, deduplicated by the
+// identity the producer stamped on it. A failed commit may be partially
+// applied, so it restarts for Recover to roll it forward before the messages
+// are redelivered.
+func (w *worker) process(message *middleware.StatsMsg, identity middleware.Identity, ack func()) error {
+	// a message that arrives after the results of its client were sent,
+	// like a redelivery, can no longer change them
+	if w.clients.Finished(message.ClientId) {
+		log.Printf("Dropping message %s of finished client %q", identity.MessageId(), message.ClientId)
+		ack()
+		return nil
 	}
 
-	defer file.Close()
-
-	var current int32
-
-	for {
-		err := binary.Read(file, binary.BigEndian, &current)
-		if err == io.EOF {
-			break
-		}
+	batch, err := w.batch(message.ClientId)
+	if err != nil {
+		return err
+	}
 
-		alreadyProcessed[int(current)] = true
+	err = batch.ProcessIdentified(identity, message, ack)
+	if err != nil {
+		log.Fatalf("failed to commit: %v", err)
 	}
 
-	return alreadyProcessed
+	return nil
 }
 
-func processStats(m *middleware.Middleware, metrics chan<- int) error {
-	alreadyProcessed := getAlreadyProcessed()
+// end commits the stats of a client, sends them as its result and then
+// deletes its database. A finished client had its result sent before a
+// restart.
+func (w *worker) end(clientId string) error {
+	if w.clients.Finished(clientId) {
+		log.Printf("Results of client %q already sent", clientId)
+		return nil
+	}
 
-	RestoreCommit(func(commit *Commit) {
-		log.Printf("Restoring stat id: %s", commit.data[0][1])
+	batch, err := w.batch(clientId)
+	if err != nil {
+		return err
+	}
 
-		err := os.Rename(commit.data[0][2], fmt.Sprintf("./database/stats/%s.csv", commit.data[0][0]))
+	err = batch.Flush()
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			log.Printf("failed to rename file: %v", err)
-			return
-		}
+	db, err := w.clients.Get(clientId)
+	if err != nil {
+		return err
+	}
 
-		id, err := strconv.Atoi(commit.data[0][1])
+	var stats []middleware.Stats
+	err = db.Stats.Iterate(func(key string, stat middleware.Stats) error {
+		appId, err := strconv.Atoi(key)
 		if err != nil {
-			log.Printf("failed to convert id to int: %v", err)
-			return
-		}
-
-		if alreadyProcessed[id] {
-			commit.end()
-			return
+			return err
 		}
-
-		updateProcessed(id)
-		alreadyProcessed[id] = true
-
-		commit.end()
+		stat.AppId = appId
+		stats = append(stats, stat)
+		return nil
 	})
-
-	queue, err := m.ListenStats(os.Getenv("ID"), "Action")
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Listening stats")
-
-	finished := false
-
-	queue.Consume(func(message *middleware.StatsMsg, ack func()) error {
-
-		if finished {
-			log.Printf("New messages when already finished :(")
-			return nil
-		}
+	queryId := strconv.Itoa(statsQuery)
+	err = w.middleware.SendResult(queryId, &middleware.Result{
+		ClientId:       clientId,
+		QueryId:        statsQuery,
+		IsFinalMessage: true,
+		Payload:        middleware.Query5Result{Stats: stats},
+	})
+	if err != nil {
+		return err
+	}
 
-		if message.Last {
-			finished = true
-			log.Printf("Last message received")
-			ack()
-			return nil
-		}
+	err = w.middleware.SendResultsFinished(queryId, clientId)
+	if err != nil {
+		return err
+	}
 
-		metrics <- 1
+	delete(w.batches, clientId)
+	log.Printf("Sent the results of client %q, %d games", clientId, len(stats))
 
-		if alreadyProcessed[message.Id] {
-			ack()
-			return nil
-		}
+	return w.clients.Remove(clientId)
+}
 
-		tmpFile, err := os.CreateTemp("./database", fmt.Sprintf("%d.csv", message.Stats.AppId))
+// flush commits the pending messages of every client.
+func (w *worker) flush() error {
+	for _, batch := range w.batches {
+		err := batch.Flush()
 		if err != nil {
-			log.Printf("failed to create temp file: %v", err)
-			return nil
+			return err
 		}
-
-		data := [][]string{
-			{strconv.Itoa(message.Stats.AppId), strconv.Itoa(message.Id), tmpFile.Name()},
-		}
-
-		updateStat(message.Stats, tmpFile)
-
-		commit := NewCommit(fmt.Sprintf("%d", message.Stats.AppId), data)
-
-		updateProcessed(message.Id)
-		alreadyProcessed[message.Id] = true
-
-		os.Rename(tmpFile.Name(), fmt.Sprintf("./database/stats/%d.csv", message.Stats.AppId))
-
-		commit.end()
-
-		ack()
-
-		return nil
-	})
-
+	}
 	return nil
 }
 
-type Commit struct {
-	commit *os.File
-	data   [][]string
-}
-
-// data: [[filename, tmpFilename],[filename, tmpFilename],[key,value]]
-
-// commitFile:
-// filename,tmpFilename
-// filename,tmpFilename
-// key,value
-// END
-func NewCommit(path string, data [][]string) *Commit {
-	commit, err := os.OpenFile("./database/commit.csv", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+func processStats(ctx context.Context, m *middleware.Middleware, clients *statsdb.Clients, metrics chan<- int) error {
+	queue, err := m.ListenStats(os.Getenv("ID"), "Action")
 	if err != nil {
-		log.Printf("failed to create commit file: %v", err)
-		return nil
+		return err
 	}
 
-	writer := csv.NewWriter(commit)
-	writer.WriteAll(data)
-	writer.Write([]string{"END"})
-	writer.Flush()
-
-	return &Commit{commit: commit, data: data}
-}
+	log.Printf("Listening stats")
 
-func RestoreCommit(onCommit func(commit *Commit)) {
-	commitFile, err := os.Open("./database/commit.csv")
-	if err != nil {
-		log.Printf("No commit file found: %v", err)
-		return
+	size, timeout := batchOptions()
+	w := &worker{
+		middleware: m,
+		clients:    clients,
+		batches:    make(map[string]*statsdb.Batch),
+		size:       size,
+		timeout:    timeout,
 	}
 
-	reader := csv.NewReader(commitFile)
-	reader.FieldsPerRecord = -1
+	queue.OnEnd(w.end)
 
-	data, err := reader.ReadAll()
+	err = queue.ConsumeIdentified(ctx, func(message *middleware.StatsMsg, identity middleware.Identity, ack func()) error {
+		metrics <- 1
+		return w.process(message, identity, ack)
+	})
 	if err != nil {
-		log.Printf("failed to read commit file: %v", err)
-		return
-	}
-
-	if len(data) == 0 {
-		log.Printf("Empty commit file")
-		return
-	}
-
-	if len(data[len(data)-1]) == 0 {
-		log.Printf("Empty commit file (2)")
-		return
-	}
-
-	if data[len(data)-1][0] != "END" {
-		log.Printf("Empty commit file (3)")
-		return
+		return err
 	}
 
-	commit := &Commit{commit: commitFile, data: data[:len(data)-1]}
-
-	onCommit(commit)
-}
-
-func (c *Commit) end() {
-	c.commit.Truncate(0)
-	c.commit.Close()
+	log.Printf("Shutting down, committing the pending messages")
+	return w.flush()
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LucasAlda/demo-falopa/middleware"
+	"github.com/LucasAlda/demo-falopa/statsdb"
+)
+
+func connect(t *testing.T, memory *middleware.Memory, producerID string) *middleware.Middleware {
+	t.Helper()
+
+	m, err := middleware.NewMiddlewareWithBroker(memory.Connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	m.SetPartitioner(middleware.Modulo(1))
+	m.SetProducerID(producerID)
+	return m
+}
+
+func stats(clientId string, appId int) *middleware.StatsMsg {
+	return &middleware.StatsMsg{
+		ClientId: clientId,
+		Stats:    &middleware.Stats{AppId: appId, Name: "Game", Genres: []string{"Action"}, Positives: 1},
+	}
+}
+
+// The stats of two clients go through the worker, which sends the result of
+// each once its end of stream arrives and then removes its database.
+func TestStatsToResults(t *testing.T) {
+	t.Setenv("ID", "0")
+	memory := middleware.NewMemory()
+
+	worker := connect(t, memory, "worker-0")
+	// declared before anything is published, which is dropped otherwise
+	if _, err := worker.ListenStats("0", "Action"); err != nil {
+		t.Fatal(err)
+	}
+
+	results := connect(t, memory, "results")
+	resultsQueue, err := results.ListenResults("5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := statsdb.OpenClients(t.TempDir(), statsdb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := make(chan int)
+	go func() {
+		for range metrics {
+		}
+	}()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- processStats(ctx, worker, clients, metrics)
+	}()
+
+	var mutex sync.Mutex
+	got := make(map[string][]middleware.Stats)
+	ended := make(chan string, 2)
+	resultsQueue.OnEnd(func(clientId string) error {
+		ended <- clientId
+		return nil
+	})
+	go resultsQueue.Consume(ctx, func(result *middleware.Result, ack func()) error {
+		mutex.Lock()
+		got[result.ClientId] = result.Payload.(middleware.Query5Result).Stats
+		mutex.Unlock()
+		ack()
+		return nil
+	})
+
+	seeder := connect(t, memory, "seeder")
+	for _, message := range []*middleware.StatsMsg{stats("a", 1), stats("b", 2), stats("a", 1), stats("b", 2), stats("a", 1)} {
+		if err := seeder.SendStats(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restart of the seeder numbers its messages the same, so the
+	// replayed one is dropped
+	replay := connect(t, memory, "seeder")
+	if err := replay.SendStats(stats("a", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, clientId := range []string{"a", "b"} {
+		if err := seeder.SendStatsFinished(clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range 2 {
+		select {
+		case <-ended:
+		case <-time.After(5 * time.Second):
+			t.Fatal("results did not end")
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	want := map[string]middleware.Stats{"a": {AppId: 1, Positives: 3}, "b": {AppId: 2, Positives: 2}}
+	for clientId, stat := range want {
+		if len(got[clientId]) != 1 || got[clientId][0].AppId != stat.AppId || got[clientId][0].Positives != stat.Positives {
+			t.Errorf("result of client %s = %+v, want %+v", clientId, got[clientId], stat)
+		}
+		if !clients.Finished(clientId) {
+			t.Errorf("client %s not finished after its result", clientId)
+		}
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The stats of two clients interleaved by a producer are numbered per client,
+// so the watermark of each database moves over all of them.
+func TestInterleavedClientsAdvanceWatermark(t *testing.T) {
+	t.Setenv("ID", "0")
+	memory := middleware.NewMemory()
+
+	worker := connect(t, memory, "worker-0")
+	if _, err := worker.ListenStats("0", "Action"); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := statsdb.OpenClients(t.TempDir(), statsdb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := make(chan int)
+	go func() {
+		for range metrics {
+		}
+	}()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- processStats(ctx, worker, clients, metrics)
+	}()
+
+	seeder := connect(t, memory, "seeder")
+	for range 3 {
+		for _, clientId := range []string{"a", "b"} {
+			if err := seeder.SendStats(stats(clientId, 1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, clientId := range []string{"a", "b"} {
+		db, err := clients.Get(clientId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var watermark int64
+			var sparse []int64
+			db.Processed.Tracker().Each(func(_ string, w int64, s []int64) {
+				watermark, sparse = w, s
+			})
+			if watermark == 3 && len(sparse) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("client %s has watermark %d and sparse %v, want 3 and none", clientId, watermark, sparse)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}